@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// shell_quote quotes word for a POSIX shell, so that it stays one word.
+func shell_quote(word string) string {
+	return "'" + strings.ReplaceAll(word, "'", `'\''`) + "'"
+}
+
+// split_args splits a command line into words, honoring single quotes,
+// double quotes and backslash escapes the way a simple shell would.
+func split_args(cmdline string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	in_word := false
+	var quote rune = 0
+	escaped := false
+
+	for _, c := range cmdline {
+		switch {
+		case escaped:
+			word.WriteRune(c)
+			escaped = false
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(c)
+			}
+		case c == '\\':
+			escaped = true
+			in_word = true
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			} else {
+				word.WriteRune(c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			in_word = true
+		case c == ' ' || c == '\t' || c == '\n':
+			if in_word {
+				words = append(words, word.String())
+				word.Reset()
+				in_word = false
+			}
+		default:
+			word.WriteRune(c)
+			in_word = true
+		}
+	}
+	if escaped {
+		return nil, fmt.Errorf("trailing backslash in %q", cmdline)
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote in %q", quote, cmdline)
+	}
+	if in_word {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
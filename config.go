@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/msoulier/mrun/supervisor"
+	"golang.org/x/sys/unix"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the pipeline definition read from the -config YAML file.
+// Anything given on the command line overrides the file.
+type Config struct {
+	PipelineConfig `yaml:",inline"`
+	Pidfile        string `yaml:"pidfile"`
+	// Several pipelines to run side by side instead of one. The settings
+	// above are the defaults of every one of them; the programs have to
+	// be given for each.
+	Pipelines []NamedPipelineConfig `yaml:"pipelines"`
+}
+
+// PipelineConfig is what the config file says about one pipeline.
+type PipelineConfig struct {
+	Producer     string   `yaml:"producer"`
+	ProducerArgs []string `yaml:"producer_args"`
+	Consumer     string   `yaml:"consumer"`
+	ConsumerArgs []string `yaml:"consumer_args"`
+	Filter       string   `yaml:"filter"`
+	FilterArgs   []string `yaml:"filter_args"`
+	// An alternative to producer and consumer for longer pipelines.
+	Stages []ConfigStage     `yaml:"stages"`
+	Env    map[string]string `yaml:"env"`
+	// One of always, never or on-failure.
+	Restart      string         `yaml:"restart"`
+	MaxRestarts  *int           `yaml:"max_restarts"`
+	RestartRate  string         `yaml:"restart_rate"`
+	RestartDelay *time.Duration `yaml:"restart_delay"`
+	Backoff      struct {
+		Base       *time.Duration `yaml:"base"`
+		Max        *time.Duration `yaml:"max"`
+		MinHealthy *time.Duration `yaml:"min_healthy"`
+	} `yaml:"backoff"`
+}
+
+// has_programs reports whether pc says what to run.
+func (pc *PipelineConfig) has_programs() bool {
+	return pc.Producer != "" || pc.Consumer != "" || pc.Filter != "" || len(pc.Stages) > 0
+}
+
+// NamedPipelineConfig is one entry of the pipelines list.
+type NamedPipelineConfig struct {
+	// Names the pipeline in the logs, the status and the metrics, and is
+	// passed to its children as MRUN_PIPELINE.
+	Name           string `yaml:"name"`
+	PipelineConfig `yaml:",inline"`
+}
+
+// Pipeline names, which end up in metric labels and log lines.
+var pipeline_name = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// ConfigStage is one entry of the stages list.
+type ConfigStage struct {
+	Command string   `yaml:"command"`
+	Args    []string `yaml:"args"`
+	Chdir   string   `yaml:"chdir"`
+}
+
+// load_config reads and validates a config file.
+func load_config(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	if err := check_pipeline_config(&cfg.PipelineConfig); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(cfg.Pipelines) > 0 && cfg.has_programs() {
+		return nil, fmt.Errorf("%s: with pipelines, the programs go in each pipeline", path)
+	}
+	names := make(map[string]bool)
+	for i, pipeline := range cfg.Pipelines {
+		if !pipeline_name.MatchString(pipeline.Name) {
+			return nil, fmt.Errorf("%s: pipeline %d needs a name of letters, digits, - and _, not %q", path, i+1, pipeline.Name)
+		}
+		if names[pipeline.Name] {
+			return nil, fmt.Errorf("%s: there are two pipelines named %s", path, pipeline.Name)
+		}
+		names[pipeline.Name] = true
+		if err := check_pipeline_config(&pipeline.PipelineConfig); err != nil {
+			return nil, fmt.Errorf("%s: pipeline %s: %v", path, pipeline.Name, err)
+		}
+	}
+	return &cfg, nil
+}
+
+// check_pipeline_config validates the settings of one pipeline.
+func check_pipeline_config(pc *PipelineConfig) error {
+	if _, err := split_args(pc.Producer); err != nil {
+		return fmt.Errorf("bad producer: %v", err)
+	}
+	if _, err := split_args(pc.Consumer); err != nil {
+		return fmt.Errorf("bad consumer: %v", err)
+	}
+	if _, err := split_args(pc.Filter); err != nil {
+		return fmt.Errorf("bad filter: %v", err)
+	}
+	for i, stage := range pc.Stages {
+		if words, err := split_args(stage.Command); err != nil || len(words) == 0 {
+			return fmt.Errorf("stage %d has a bad command %q", i+1, stage.Command)
+		}
+	}
+	switch pc.Restart {
+	case "", "always", "never", "on-failure":
+	default:
+		return fmt.Errorf("restart must be always, never or on-failure, not %q", pc.Restart)
+	}
+	if pc.RestartRate != "" {
+		if _, err := supervisor.ParseRate(pc.RestartRate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flag_set reports whether the named flag was given on the command line.
+func flag_set(name string) bool {
+	found := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			found = true
+		}
+	})
+	return found
+}
+
+func apply_duration(dst *time.Duration, value *time.Duration, name string) {
+	if value != nil && !flag_set(name) {
+		*dst = *value
+	}
+}
+
+// apply_config copies the settings in cfg into the globals, skipping any
+// that were given on the command line.
+func apply_config(cfg *Config) error {
+	if err := apply_pipeline_config(&cfg.PipelineConfig); err != nil {
+		return err
+	}
+	if cfg.Pidfile != "" && !flag_set("pidfile") {
+		pidfile = cfg.Pidfile
+	}
+	return nil
+}
+
+// apply_pipeline_config is apply_config for the settings of a pipeline.
+func apply_pipeline_config(cfg *PipelineConfig) error {
+	if cfg.Producer != "" && !flag_set("producer") {
+		path, args, err := resolve_command(cfg.Producer, cfg.ProducerArgs)
+		if err != nil {
+			return fmt.Errorf("bad producer: %v", err)
+		}
+		producer, producer_args = path, args
+	}
+	if cfg.Consumer != "" && !flag_set("consumer") {
+		path, args, err := resolve_command(cfg.Consumer, cfg.ConsumerArgs)
+		if err != nil {
+			return fmt.Errorf("bad consumer: %v", err)
+		}
+		consumer, consumer_args = path, args
+	}
+	if cfg.Filter != "" && !flag_set("filter") {
+		path, args, err := resolve_command(cfg.Filter, cfg.FilterArgs)
+		if err != nil {
+			return fmt.Errorf("bad filter: %v", err)
+		}
+		filter, filter_args = path, args
+	}
+	if len(cfg.Stages) > 0 && !flag_set("stage") {
+		specs := make([]supervisor.Stage, 0, len(cfg.Stages))
+		for i, stage := range cfg.Stages {
+			path, args, err := resolve_command(stage.Command, stage.Args)
+			if err != nil {
+				return fmt.Errorf("bad stage %d: %v", i+1, err)
+			}
+			specs = append(specs, supervisor.Stage{Path: path, Args: args, Dir: stage.Chdir})
+		}
+		stage_specs = specs
+	}
+
+	// -env flags are applied after these, so they win.
+	config_env = nil
+	for key, value := range cfg.Env {
+		config_env = append(config_env, key+"="+value)
+	}
+	sort.Strings(config_env)
+
+	if cfg.Restart != "" && !flag_set("norestart") && !flag_set("restart-on-failure") {
+		norestart = cfg.Restart == "never"
+		restart_on_failure = cfg.Restart == "on-failure"
+	}
+	if cfg.MaxRestarts != nil && !flag_set("max-restarts") {
+		max_restarts = *cfg.MaxRestarts
+	}
+	if cfg.RestartRate != "" && !flag_set("restart-rate") {
+		restart_rate_spec = cfg.RestartRate
+	}
+	apply_duration(&restart_delay, cfg.RestartDelay, "restart-delay")
+	apply_duration(&backoff_base, cfg.Backoff.Base, "backoff-base")
+	apply_duration(&backoff_max, cfg.Backoff.Max, "backoff-max")
+	if !flag_set("healthy-after") {
+		apply_duration(&min_healthy, cfg.Backoff.MinHealthy, "min-healthy")
+	}
+	return nil
+}
+
+// check_stages logs every stage whose program we can't run, and reports
+// whether there were none.
+func check_stages(stages []supervisor.Stage) bool {
+	ok := true
+	for _, stage := range stages {
+		if err := check_executable(stage.Path); err != nil {
+			log.Errorf("Bad %s: %v", stage.Role, err)
+			ok = false
+		}
+	}
+	return ok
+}
+
+// check_executable verifies that path is a regular file that we are
+// allowed to execute.
+func check_executable(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", path)
+	}
+	if err := unix.Faccessat(unix.AT_FDCWD, path, unix.X_OK, unix.AT_EACCESS); err != nil {
+		return fmt.Errorf("%s is not executable: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/msoulier/mrun/supervisor"
+)
+
+// control_handler answers the API call at one path. call does the work
+// and returns the status to send back, or nil for a plain ok.
+func control_handler(method string, call func(r *http.Request) (any, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		status, err := call(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if status != nil {
+			json.NewEncoder(w).Encode(status)
+			return
+		}
+		fmt.Fprintf(w, "{\"ok\":true}\n")
+	}
+}
+
+// log_status logs the state of the pipeline, or of every pipeline, for
+// SIGUSR1.
+func log_status() {
+	if len(pipelines) == 0 {
+		log_pipeline_status("", sup, stages)
+		return
+	}
+	for _, p := range pipelines {
+		log_pipeline_status("Pipeline "+p.name+": ", p.sup, p.options.Stages)
+	}
+}
+
+// log_pipeline_status logs the state of the pipeline s runs, each line
+// starting with prefix.
+func log_pipeline_status(prefix string, s *supervisor.Supervisor, stages []supervisor.Stage) {
+	status, err := s.Status()
+	if err != nil {
+		log.Warningf("%sNo status: %v", prefix, err)
+		return
+	}
+	log.Infof("%sUp for %v", prefix, time.Duration(status.UptimeSeconds*float64(time.Second)).Round(time.Second))
+	for _, stage := range stages {
+		role := stage.Role
+		line := fmt.Sprintf("%s%s: PID %d, %d restarts", prefix, role, status.Pids[role], status.Restarts[role])
+		if uptime, ok := status.StageUptimeSeconds[role]; ok {
+			line += fmt.Sprintf(", up for %v", time.Duration(uptime*float64(time.Second)).Round(time.Second))
+		}
+		if exit, ok := status.LastExitStatus[role]; ok {
+			line += fmt.Sprintf(", last exit %d at %s", exit, status.LastExitTime[role].Format(time.DateTime))
+		}
+		if pumped, ok := status.Pumped[role]; ok {
+			line += fmt.Sprintf(", %d bytes and %d lines pumped", pumped.Bytes, pumped.Lines)
+		}
+		log.Info(line)
+	}
+}
+
+// stop_requested shuts mrun down gracefully on a request from via.
+func stop_requested(via string) {
+	log.Warningf("Stop requested through %s", via)
+	stopping_because("stop_requested")
+	notify_stopping()
+	stop_all()
+}
+
+var control_server *http.Server
+
+// start_control serves the control API on addr.
+func start_control(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", control_handler(http.MethodGet, func(r *http.Request) (any, error) {
+		return status()
+	}))
+	mux.HandleFunc("/restart", control_handler(http.MethodPost, func(r *http.Request) (any, error) {
+		return nil, restart(r.URL.Query().Get("pipeline"))
+	}))
+	mux.HandleFunc("/stop", control_handler(http.MethodPost, func(r *http.Request) (any, error) {
+		stop_requested("the control API")
+		return nil, nil
+	}))
+	control_server = &http.Server{Handler: mux}
+	go func() {
+		if err := control_server.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Errorf("Control server failed: %v", err)
+		}
+	}()
+	log.Infof("Serving the control API on http://%s", l.Addr())
+	return nil
+}
+
+// stop_control shuts the control server down, if it is running.
+func stop_control() {
+	if control_server == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	control_server.Shutdown(ctx)
+	control_server = nil
+}
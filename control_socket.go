@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The line protocol of -control-socket: one command per line, STATUS,
+// RESTART, STOP or RELOAD in any case, each answered with one line.
+// STATUS returns the JSON of GET /status, the others OK or ERR and why.
+// RESTART may name the pipeline to restart, as in RESTART web.
+
+var control_listener net.Listener
+
+// start_control_socket serves the line protocol on the unix socket path,
+// or on the socket systemd passed us if we were socket activated. It
+// refuses to take over a socket that another process still serves, and
+// removes one left behind by a process that is gone.
+func start_control_socket(path string) error {
+	l, err := activated_listener()
+	if err != nil {
+		return err
+	}
+	if l == nil {
+		if l, err = listen_unix(path); err != nil {
+			return err
+		}
+	}
+	control_listener = l
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					log.Errorf("Control socket failed: %v", err)
+				}
+				return
+			}
+			go serve_control_conn(conn)
+		}
+	}()
+	log.Infof("Serving the control protocol on %s", l.Addr())
+	return nil
+}
+
+// listen_unix listens on a new unix socket at path, only for our user.
+func listen_unix(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another process", path)
+		}
+		log.Debugf("Removing the stale socket %s", path)
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	// Created with the umask, which is process wide, so it is set only
+	// around the Listen. No child has been started yet to inherit it.
+	old := syscall.Umask(0177)
+	l, err := net.Listen("unix", path)
+	syscall.Umask(old)
+	if err != nil {
+		return nil, err
+	}
+	// A backstop, the socket must not be left open to others.
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// activated_listener returns the first socket systemd passed us, or nil
+// if we weren't socket activated.
+func activated_listener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	fds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || fds < 1 {
+		return nil, nil
+	}
+	file := os.NewFile(3, "LISTEN_FD_3")
+	defer file.Close()
+	l, err := net.FileListener(file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot use the socket passed by systemd: %v", err)
+	}
+	return l, nil
+}
+
+// serve_control_conn answers the commands of one client until it hangs
+// up.
+func serve_control_conn(conn net.Conn) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		command := strings.TrimSpace(scanner.Text())
+		if command == "" {
+			continue
+		}
+		if _, err := fmt.Fprintln(conn, control_command(command)); err != nil {
+			return
+		}
+	}
+}
+
+// control_command runs one command of the line protocol and returns the
+// answer.
+func control_command(command string) string {
+	var err error
+	command, arg, _ := strings.Cut(command, " ")
+	arg = strings.TrimSpace(arg)
+	if arg != "" && !strings.EqualFold(command, "RESTART") {
+		return fmt.Sprintf("ERR %s takes no argument", strings.ToUpper(command))
+	}
+	switch strings.ToUpper(command) {
+	case "STATUS":
+		status, err := status()
+		if err != nil {
+			return "ERR " + err.Error()
+		}
+		data, err := json.Marshal(status)
+		if err != nil {
+			return "ERR " + err.Error()
+		}
+		return string(data)
+	case "RESTART":
+		err = restart(arg)
+	case "STOP":
+		stop_requested("the control socket")
+	case "RELOAD":
+		log.Warning("Reload requested through the control socket")
+		err = request_reload()
+	default:
+		return fmt.Sprintf("ERR unknown command %q, expected STATUS, RESTART, STOP or RELOAD", command)
+	}
+	if err != nil {
+		return "ERR " + err.Error()
+	}
+	return "OK"
+}
+
+// stop_control_socket stops serving the control socket, which removes
+// it unless systemd owns it.
+func stop_control_socket() {
+	if control_listener == nil {
+		return
+	}
+	control_listener.Close()
+	control_listener = nil
+}
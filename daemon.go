@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// -daemonize works the classic way, with a fork being an exec of
+// ourselves: the mrun started from the shell starts a copy in a new
+// session, which starts another one and exits. That one is no session
+// leader, so it can't get a controlling terminal again, and is the
+// daemon. It reports on fd 3 once the pipeline is up, and the first mrun
+// exits then.
+const (
+	daemon_env       = "MRUN_DAEMON"
+	daemon_status_fd = 3
+)
+
+// Where the daemon reports to the mrun it was started from, nil if we
+// aren't one.
+var daemon_status *os.File
+
+// daemon_stage is called first thing, to carry on with -daemonize in the
+// copies of mrun it starts.
+func daemon_stage() {
+	switch os.Getenv(daemon_env) {
+	case "session":
+		status := os.NewFile(daemon_status_fd, "daemon status")
+		os.Setenv(daemon_env, "daemon")
+		_, err := os.StartProcess("/proc/self/exe", os.Args, &os.ProcAttr{
+			Files: []*os.File{os.Stdin, os.Stdout, os.Stderr, status},
+		})
+		if err != nil {
+			// Onto the -logfile, the first mrun only sees us exit.
+			fmt.Fprintf(os.Stderr, "mrun: cannot start the daemon: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "daemon":
+		os.Unsetenv(daemon_env)
+		daemon_status = os.NewFile(daemon_status_fd, "daemon status")
+	}
+}
+
+// start_daemon starts the daemon, and exits once it has the pipeline up,
+// or with 1 if it exits before that. Its stdin is /dev/null and its
+// stdout and stderr, and so those of the children, are appended to the
+// -logfile, or go to /dev/null without one.
+func start_daemon() {
+	null, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		log.Errorf("Cannot daemonize: %v", err)
+		os.Exit(1)
+	}
+	out := null
+	if logfile != "" {
+		out, err = os.OpenFile(logfile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			log.Errorf("Cannot daemonize: %v", err)
+			os.Exit(1)
+		}
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		log.Errorf("Cannot daemonize: %v", err)
+		os.Exit(1)
+	}
+	os.Setenv(daemon_env, "session")
+	proc, err := os.StartProcess("/proc/self/exe", os.Args, &os.ProcAttr{
+		Files: []*os.File{null, out, out, w},
+		Sys:   &syscall.SysProcAttr{Setsid: true},
+	})
+	if err != nil {
+		log.Errorf("Cannot daemonize: %v", err)
+		os.Exit(1)
+	}
+	w.Close()
+	// It only starts the daemon.
+	proc.Wait()
+	status, _ := io.ReadAll(r)
+	if pid, ok := strings.CutPrefix(strings.TrimSpace(string(status)), "ready "); ok {
+		log.Infof("mrun is running in the background as PID %s", pid)
+		os.Exit(0)
+	}
+	if logfile != "" {
+		log.Errorf("mrun stopped before the pipeline was up, see %s", logfile)
+	} else {
+		log.Error("mrun stopped before the pipeline was up, run it without -daemonize to see why")
+	}
+	os.Exit(1)
+}
+
+// notify_daemonizer tells the mrun that started the daemon once the
+// pipeline is up.
+func notify_daemonizer() {
+	if daemon_status == nil {
+		return
+	}
+	go func() {
+		<-all_ready()
+		daemon_status.WriteString("ready " + strconv.Itoa(os.Getpid()) + "\n")
+		daemon_status.Close()
+	}()
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// read_env_file reads KEY=VALUE lines from a dotenv file. Blank lines
+// and lines starting with # are skipped, and a line may start with
+// "export ". A value may be in single quotes, taken as is, or in double
+// quotes, where \n, \t, \", \\ and \$ are escapes; an unquoted value
+// ends at a " #" comment and has the spaces around it trimmed.
+func read_env_file(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var env []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		key, value, found := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !found || !valid_env_key(key) {
+			return nil, fmt.Errorf("%s:%d: expected KEY=VALUE", path, n)
+		}
+		value, err := parse_env_value(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		env = append(env, key+"="+value)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return env, nil
+}
+
+// valid_env_key reports whether key is a shell variable name.
+func valid_env_key(key string) bool {
+	if key == "" {
+		return false
+	}
+	for i, c := range key {
+		switch {
+		case c == '_', c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// parse_env_value unquotes the value of a dotenv line.
+func parse_env_value(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	quote := value[0]
+	if quote != '\'' && quote != '"' {
+		if i := strings.Index(value, " #"); i >= 0 {
+			value = value[:i]
+		}
+		return strings.TrimSpace(value), nil
+	}
+	var out strings.Builder
+	escaped := false
+	for i := 1; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case escaped:
+			switch c {
+			case 'n':
+				out.WriteByte('\n')
+			case 't':
+				out.WriteByte('\t')
+			case '"', '\\', '$':
+				out.WriteByte(c)
+			default:
+				out.WriteByte('\\')
+				out.WriteByte(c)
+			}
+			escaped = false
+		case c == '\\' && quote == '"':
+			escaped = true
+		case c == quote:
+			rest := strings.TrimSpace(value[i+1:])
+			if rest != "" && !strings.HasPrefix(rest, "#") {
+				return "", fmt.Errorf("unexpected %q after the closing quote", rest)
+			}
+			return out.String(), nil
+		default:
+			out.WriteByte(c)
+		}
+	}
+	return "", fmt.Errorf("unterminated %c quote", quote)
+}
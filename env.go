@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/msoulier/mrun/supervisor"
+)
+
+// EnvFlag collects repeated -env KEY=VALUE flags.
+type EnvFlag []string
+
+func (e *EnvFlag) String() string {
+	return strings.Join(*e, ",")
+}
+
+func (e *EnvFlag) Set(value string) error {
+	key, _, found := strings.Cut(value, "=")
+	if !found || key == "" {
+		return fmt.Errorf("expected KEY=VALUE, got %q", value)
+	}
+	*e = append(*e, value)
+	return nil
+}
+
+// Variables of ours that -clean-env still passes on.
+var clean_env_keep = []string{"PATH", "HOME"}
+
+// Variables of ours that are never passed on, those of systemd socket
+// activation, which are meant for us.
+var activation_env = []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"}
+
+// base_env returns the environment the children's variables are added
+// to: ours, or with -clean-env only clean_env_keep of it.
+func base_env() []string {
+	if !clean_env {
+		return slices.DeleteFunc(supervisor.Environ(), func(kv string) bool {
+			key, _, _ := strings.Cut(kv, "=")
+			return slices.Contains(activation_env, key)
+		})
+	}
+	var env []string
+	for _, key := range clean_env_keep {
+		if value, ok := os.LookupEnv(key); ok {
+			env = append(env, key+"="+value)
+		}
+	}
+	return env
+}
+
+// merge_env returns base with each KEY=VALUE in overrides applied in
+// order, so the last setting of a key wins. An empty value sets the
+// variable to the empty string rather than removing it.
+func merge_env(base []string, overrides []string) []string {
+	env := make([]string, 0, len(base)+len(overrides))
+	index := make(map[string]int)
+	for _, kv := range append(append([]string{}, base...), overrides...) {
+		key, _, _ := strings.Cut(kv, "=")
+		if i, ok := index[key]; ok {
+			env[i] = kv
+			continue
+		}
+		index[key] = len(env)
+		env = append(env, kv)
+	}
+	return env
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/msoulier/mrun/supervisor"
+)
+
+// What is done with each lifecycle event, in turn, from one goroutine.
+// They must not block.
+var event_handlers []func(supervisor.Event)
+
+// Closed once every event has been handled.
+var events_done chan struct{}
+
+// open_events_file appends the supervisor's lifecycle events to path,
+// one JSON object per line. The file is opened here so that a bad path
+// is reported at startup.
+func open_events_file(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	event_handlers = append(event_handlers, func(ev supervisor.Event) {
+		if err := enc.Encode(ev); err != nil {
+			log.Errorf("Cannot write the event to %s: %v", path, err)
+		}
+	})
+	return nil
+}
+
+// start_events passes the events on to the event_handlers, if any.
+func start_events() {
+	if len(event_handlers) == 0 {
+		return
+	}
+	events_done = make(chan struct{})
+	go func() {
+		defer close(events_done)
+		for ev := range sup.Events() {
+			for _, handle := range event_handlers {
+				handle(ev)
+			}
+		}
+	}()
+}
+
+// stop_events waits a little for the last events to be handled.
+func stop_events() {
+	if events_done == nil {
+		return
+	}
+	select {
+	case <-events_done:
+	case <-time.After(time.Second):
+	}
+}
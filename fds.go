@@ -0,0 +1,27 @@
+package main
+
+import (
+	"os"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// cloexec_inherited marks the fds mrun inherited from its own parent,
+// other than stdin, stdout and stderr, close-on-exec. Everything mrun
+// opens itself already is, so the children only get the fds they are
+// handed explicitly.
+func cloexec_inherited() {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		log.Debugf("Cannot list our fds: %v", err)
+		return
+	}
+	for _, entry := range entries {
+		fd, err := strconv.Atoi(entry.Name())
+		if err != nil || fd <= 2 {
+			continue
+		}
+		unix.CloseOnExec(fd)
+	}
+}
@@ -5,4 +5,5 @@ go 1.24.0
 require (
 	github.com/op/go-logging v0.0.0-20160315200505-970db520ece7
 	golang.org/x/sys v0.40.0
+	gopkg.in/yaml.v3 v3.0.1
 )
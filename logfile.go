@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// RotatingFile is an io.Writer for the log file that rotates it once it
+// grows past max_size, keeping max_files old copies as path.1, path.2
+// and so on. It is safe for concurrent use.
+type RotatingFile struct {
+	mu        sync.Mutex
+	path      string
+	max_size  int64
+	max_files int
+	file      *os.File
+	size      int64
+}
+
+func open_rotating_file(path string, max_size int64, max_files int) (*RotatingFile, error) {
+	r := &RotatingFile{path: path, max_size: max_size, max_files: max_files}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *RotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.file = f
+	r.size = info.Size()
+	return nil
+}
+
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return 0, fmt.Errorf("%s is closed", r.path)
+	}
+	if r.max_size > 0 && r.size > 0 && r.size+int64(len(p)) > r.max_size {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the old copies up by one and starts a fresh file. The
+// caller holds the lock.
+func (r *RotatingFile) rotate() error {
+	r.file.Close()
+	r.file = nil
+	if r.max_files < 1 {
+		os.Remove(r.path)
+	} else {
+		for i := r.max_files - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+		}
+		os.Rename(r.path, r.path+".1")
+	}
+	return r.open()
+}
+
+// Reopen closes and reopens the file, for use after an external tool
+// like logrotate has moved it away.
+func (r *RotatingFile) Reopen() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file != nil {
+		r.file.Close()
+		r.file = nil
+	}
+	return r.open()
+}
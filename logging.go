@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/syslog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/msoulier/mrun/supervisor"
+	"github.com/op/go-logging"
+)
+
+// setup_logging configures the logging backends: stderr, and optionally
+// a size rotated log file and syslog. With -quiet stderr only gets
+// warnings and errors, the others still get everything.
+func setup_logging() error {
+	if err := check_time_layout(log_timeformat); err != nil {
+		return fmt.Errorf("bad -log-timeformat: %v", err)
+	}
+	if log_tag == "" || strings.ContainsAny(log_tag, " \t\n") {
+		return fmt.Errorf("bad -log-tag %q", log_tag)
+	}
+	// The default tag isn't shown, so the usual lines stay the same.
+	tag := ""
+	if log_tag != "mrun" {
+		tag = "%{module} "
+	}
+	var format logging.Formatter = logging.MustStringFormatter(
+		`%{time:` + log_timeformat + `} ` + tag + `%{level} [%{shortfile}] %{message}`,
+	)
+	if log_json {
+		format = JSONFormatter{}
+	}
+	if log_utc {
+		format = utc_formatter{format}
+	}
+	var backends []logging.Backend
+	var stderrLevelled logging.LeveledBackend
+	if log_stderr {
+		stderrBackend := logging.NewLogBackend(os.Stderr, "", 0)
+		stderrLevelled = logging.AddModuleLevel(logging.NewBackendFormatter(stderrBackend, format))
+		backends = append(backends, stderrLevelled)
+	}
+	if logfile != "" {
+		max_size, err := parse_size(logmaxsize)
+		if err != nil {
+			return fmt.Errorf("bad -logmaxsize: %v", err)
+		}
+		log_writer, err = open_rotating_file(logfile, max_size, logmaxfiles)
+		if err != nil {
+			return err
+		}
+		fileBackend := logging.NewLogBackend(log_writer, "", 0)
+		backends = append(backends, logging.NewBackendFormatter(fileBackend, format))
+	}
+	if use_syslog || syslog_addr != "" {
+		writer, err := open_syslog(syslog_addr)
+		if err != nil {
+			return fmt.Errorf("cannot connect to syslog: %v", err)
+		}
+		// syslog adds its own timestamp and tag, and the level maps to
+		// the message priority.
+		syslogFormat := logging.MustStringFormatter(`[%{shortfile}] %{message}`)
+		syslogBackend := &logging.SyslogBackend{Writer: writer}
+		backends = append(backends, logging.NewBackendFormatter(syslogBackend, syslogFormat))
+	}
+
+	backendLevelled := logging.SetBackend(backends...)
+	if debug {
+		backendLevelled.SetLevel(logging.DEBUG, log_tag)
+	} else {
+		backendLevelled.SetLevel(logging.INFO, log_tag)
+	}
+	// After the above, which sets the level of every backend.
+	if quiet && stderrLevelled != nil {
+		stderrLevelled.SetLevel(logging.WARNING, log_tag)
+	}
+	log = logging.MustGetLogger(log_tag)
+	supervisor.SetLogModule(log_tag)
+	return nil
+}
+
+// check_time_layout makes sure layout is a time layout that formats
+// into something that tells times apart, and fits in the log format.
+func check_time_layout(layout string) error {
+	if strings.Contains(layout, "}") {
+		return fmt.Errorf("%q can't contain }", layout)
+	}
+	a := time.Date(2001, 2, 3, 4, 5, 6, 7000000, time.UTC).Format(layout)
+	b := time.Date(2002, 3, 4, 5, 6, 7, 8000000, time.UTC).Format(layout)
+	if a == b {
+		return fmt.Errorf("%q has no date or time in it", layout)
+	}
+	return nil
+}
+
+// utc_formatter formats records with their time in UTC.
+type utc_formatter struct {
+	logging.Formatter
+}
+
+func (f utc_formatter) Format(calldepth int, r *logging.Record, w io.Writer) error {
+	r.Time = r.Time.UTC()
+	return f.Formatter.Format(calldepth+1, r, w)
+}
+
+// open_syslog connects to the local syslog daemon, or to addr if given.
+// addr is host:port for UDP, or network://host:port, e.g.
+// tcp://loghost:514.
+func open_syslog(addr string) (*syslog.Writer, error) {
+	priority := syslog.LOG_DAEMON | syslog.LOG_INFO
+	if addr == "" {
+		return syslog.New(priority, log_tag)
+	}
+	network := "udp"
+	if n, a, found := strings.Cut(addr, "://"); found {
+		network, addr = n, a
+	}
+	return syslog.Dial(network, addr, priority, log_tag)
+}
+
+// reopen_logfile reopens the log file after external rotation.
+func reopen_logfile() {
+	if log_writer == nil {
+		return
+	}
+	if err := log_writer.Reopen(); err != nil {
+		fmt.Fprintf(os.Stderr, "mrun: cannot reopen %s: %v\n", logfile, err)
+		return
+	}
+	log.Infof("Reopened log file %s", logfile)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/msoulier/mrun/supervisor"
+	"github.com/op/go-logging"
+)
+
+// JSONFormatter formats each record as a single line JSON object. The
+// fields of a supervisor.FieldMessage argument become keys of their own.
+type JSONFormatter struct{}
+
+func (JSONFormatter) Format(calldepth int, r *logging.Record, w io.Writer) error {
+	entry := make(map[string]interface{})
+	for _, arg := range r.Args {
+		if m, ok := arg.(supervisor.FieldMessage); ok {
+			for key, value := range m.Fields {
+				entry[key] = value
+			}
+		}
+	}
+	entry["timestamp"] = r.Time.Format(time.RFC3339Nano)
+	entry["level"] = r.Level.String()
+	entry["module"] = r.Module
+	entry["message"] = r.Message()
+	if _, file, line, ok := runtime.Caller(calldepth + 1); ok {
+		entry["file"] = fmt.Sprintf("%s:%d", filepath.Base(file), line)
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
@@ -1,237 +1,1006 @@
 package main
 
 import (
-	"os"
-	"syscall"
-	"path/filepath"
+	"errors"
 	"flag"
+	"fmt"
+	"math"
+	"os"
 	"os/signal"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
-	"golang.org/x/sys/unix"
+	"github.com/msoulier/mrun/supervisor"
 	"github.com/op/go-logging"
+	"golang.org/x/sys/unix"
 )
 
-type Policy int64
-
+// Exit codes for the ways mrun can give up on a pipeline.
 const (
-	Restart Policy = iota
-	NoRestart
+	ExitMaxRestarts = 3
+	ExitRateLimited = 4
 )
 
 var (
 	log	*logging.Logger = nil
 	debug bool = false
+	quiet bool = false
+	show_version bool = false
 	producer string = ""
 	consumer string = ""
-	policy Policy = Restart
+	producer_args []string = nil
+	consumer_args []string = nil
+	// Optional stage between the producer and the consumer.
+	filter string = ""
+	filter_args []string = nil
+	filter_spec string = ""
+	stage_flags StageFlag
+	consumer_flags StageFlag
+	// Consumers after the first, when -consumer is repeated.
+	more_consumers []supervisor.Stage = nil
+	producer_flags StageFlag
+	// Producers after the first, when -producer is repeated.
+	more_producers []supervisor.Stage = nil
+	// Set when the producer's output is copied to several consumers.
+	fan_out bool = false
+	// Set when the output of several producers is merged.
+	fan_in bool = false
+	// Stages from -stage or the config file.
+	stage_specs []supervisor.Stage = nil
+	// The pipeline, built from one of the above.
+	stages []supervisor.Stage = nil
+	env_overrides EnvFlag
+	clean_env bool = false
+	env_file string = ""
+	// Environment from the config file, applied before env_overrides.
+	config_env []string = nil
+	chdir string = ""
+	producer_chdir string = ""
+	consumer_chdir string = ""
+	run_user string = ""
+	run_group string = ""
+	creds *supervisor.Credentials = nil
+	pidfile string = ""
+	daemonize bool = false
+	pids_file string = ""
+	on_restart string = ""
+	on_restart_required bool = false
+	hook_timeout time.Duration = 0
+	pre_start string = ""
+	post_stop string = ""
+	stop_timeout time.Duration = 10 * time.Second
+	stop_signal string = "TERM"
+	use_shell bool = false
+	rlimit_as string = ""
+	producer_nice int = 0
+	consumer_nice int = 0
+	nice_required bool = false
+	producer_oom_score_adj int = 0
+	producer_health_cmd string = ""
+	consumer_health_cmd string = ""
+	health_interval time.Duration = 10 * time.Second
+	health_retries int = 3
+	consumer_oom_score_adj int = 0
+	producer_start_delay time.Duration = 0
+	consumer_start_delay time.Duration = 0
+	start_delay_on_restart bool = false
+	stdin_file string = ""
+	stdout_file string = ""
+	stdout_append bool = false
+	tee_file string = ""
+	tee_append bool = false
+	compress string = ""
+	rlimit_nofile int = 0
+	umask string = ""
+	rlimit_cpu time.Duration = 0
+	cgroup string = ""
+	cgroup_memory_max string = ""
+	cgroup_cpu_max float64 = 0
+	shell_path string = "/bin/sh"
+	run_timeout time.Duration = 0
+	forward_signals bool = false
+	capture_stderr bool = false
+	no_pgroup bool = false
+	pipe_size string = "0"
+	pump bool = false
+	bidirectional bool = false
+	transport string = "pipe"
+	transport_addr string = "127.0.0.1:0"
+	fifo string = ""
+	fifo_keep bool = false
+	drain_timeout time.Duration = 0
+	zdd bool = false
+	pty bool = false
+	spill bool = false
+	spill_max string = "64M"
+	spill_full string = "drop"
+	balance string = ""
+	balance_buffer int = 1000
+	balance_full string = "skip"
+	partition_by int = 0
+	delimiter string = "\t"
+	pump_buffer string = "32K"
+	stall_timeout time.Duration = 0
+	stall_restart bool = false
 	norestart bool = false
-	shutdown_asap bool = false
-	// number of retry attempts?
-	// rate limiting?
+	once bool = false
+	independent_restart bool = false
+	producer_policy string = ""
+	consumer_policy string = ""
+	consumer_ready_cmd string = ""
+	ready_timeout time.Duration = 30 * time.Second
+	stage_exit_codes bool = false
+	backoff_base time.Duration = 100 * time.Millisecond
+	backoff_max time.Duration = 30 * time.Second
+	min_healthy time.Duration = 10 * time.Second
+	max_restarts int = 0
+	max_runtime time.Duration = 0
+	restart_at string = ""
+	watch_files bool = false
+	restart_jitter time.Duration = 0
+	restart_rate_spec string = ""
+	restart_rate_grace time.Duration = 5 * time.Minute
+	restart_delay time.Duration = 0
+	restart_on_failure bool = false
+	config_path string = ""
+	config_check bool = false
+	log_stderr bool = true
+	logfile string = ""
+	logmaxsize string = "0"
+	logmaxfiles int = 5
+	log_writer *RotatingFile = nil
+	use_syslog bool = false
+	syslog_addr string = ""
+	log_json bool = false
+	log_timeformat string = "2006-01-02 15:04:05.000-0700"
+	log_utc bool = false
+	log_tag string = "mrun"
+	metrics_addr string = ""
+	statsd_addr string = ""
+	statsd_prefix string = "mrun"
+	control_addr string = ""
+	control_socket string = ""
+	events_file string = ""
+	webhook_url string = ""
+	otel_endpoint string = ""
+	flap_threshold int = 0
+	flap_window time.Duration = time.Minute
+	flap_cooldown time.Duration = 5 * time.Minute
+	// The settings above, as passed to the supervisor.
+	options supervisor.Options
+	sup *supervisor.Supervisor = nil
 )
 
 func init() {
+	daemon_stage()
+	flag.BoolVar(&show_version, "version", false, "Print the version and exit")
 	flag.BoolVar(&debug, "debug", false, "Debug logging")
+	flag.BoolVar(&quiet, "quiet", false, "Only log warnings and errors to stderr")
+	flag.BoolVar(&log_stderr, "log-stderr", true, "Log to stderr")
+	flag.StringVar(&logfile, "logfile", "", "Also log to this file")
+	flag.StringVar(&logmaxsize, "logmaxsize", "0", "Rotate the log file once it reaches this size, e.g. 10M (0 never rotates)")
+	flag.IntVar(&logmaxfiles, "logmaxfiles", 5, "Number of rotated log files to keep")
+	flag.BoolVar(&use_syslog, "syslog", false, "Also log to syslog")
+	flag.StringVar(&syslog_addr, "syslog-addr", "", "Log to a remote syslog at host:port or network://host:port, implies -syslog")
+	flag.StringVar(&log_tag, "log-tag", "mrun", "Module name to log as, which the log lines and the syslog tag show, to tell several mrun apart")
+	flag.BoolVar(&log_json, "logjson", false, "Log one JSON object per line to stderr and the log file")
+	flag.StringVar(&log_timeformat, "log-timeformat", "2006-01-02 15:04:05.000-0700", "Go time layout of the log timestamps, e.g. 2006-01-02T15:04:05.000Z07:00 (not for -logjson)")
+	flag.BoolVar(&log_utc, "log-utc", false, "Log timestamps in UTC rather than local time")
+	flag.StringVar(&metrics_addr, "metrics-addr", "", "Serve Prometheus metrics on this address, e.g. :9100")
+	flag.StringVar(&statsd_addr, "statsd-addr", "", "Send the restarts and run durations to StatsD at this host:port over UDP")
+	flag.StringVar(&statsd_prefix, "statsd-prefix", "mrun", "Prefix of the StatsD metric names")
+	flag.StringVar(&control_addr, "control-addr", "", "Serve the HTTP control API on this address")
+	flag.StringVar(&control_socket, "control-socket", "", "Serve the line control protocol on this unix socket")
+	flag.StringVar(&events_file, "events-file", "", "Append the lifecycle events of the children to this file, one JSON object per line")
+	flag.StringVar(&otel_endpoint, "otel-endpoint", "", "Send a trace span for every run of a child to this OTLP/HTTP endpoint, e.g. http://localhost:4318 (default from OTEL_EXPORTER_OTLP_ENDPOINT)")
+	flag.StringVar(&webhook_url, "webhook-url", "", "POST a JSON payload to this URL before every restart and when mrun stops")
+	flag.StringVar(&config_path, "config", "", "Load the pipeline definition from this YAML file")
+	flag.BoolVar(&config_check, "config-check", false, "Validate the configuration and exit without starting anything")
+	flag.Var(&env_overrides, "env", "Set KEY=VALUE in the children's environment (repeatable)")
+	flag.StringVar(&env_file, "env-file", "", "Add the KEY=VALUE lines of this dotenv file to the children's environment")
+	flag.BoolVar(&clean_env, "clean-env", false, "Start the children with only PATH, HOME and the variables given with -env, instead of mrun's environment")
+	flag.StringVar(&chdir, "chdir", "", "Working directory for the children")
+	flag.StringVar(&producer_chdir, "producer-chdir", "", "Working directory for the producer, overrides -chdir")
+	flag.StringVar(&consumer_chdir, "consumer-chdir", "", "Working directory for the consumer, overrides -chdir")
+	flag.StringVar(&run_user, "user", "", "Run the children as this user")
+	flag.StringVar(&run_group, "group", "", "Run the children as this group")
+	flag.StringVar(&pidfile, "pidfile", "", "Write mrun's PID to this file")
+	flag.BoolVar(&daemonize, "daemonize", false, "Detach from the terminal and run in the background, once the pipeline is up")
+	flag.StringVar(&pids_file, "pids-file", "", "Keep the PIDs of the children in this file as JSON")
+	flag.StringVar(&stop_signal, "stop-signal", "TERM", "Signal that stops the children, a name like TERM, INT or QUIT, or a number")
+	flag.DurationVar(&stop_timeout, "stop-timeout", 10*time.Second, "How long to wait for children to exit after the stop signal before sending SIGKILL")
+	flag.StringVar(&rlimit_as, "rlimit-as", "", "Limit the address space of each child to this size, e.g. 512M")
+	flag.IntVar(&rlimit_nofile, "rlimit-nofile", 0, "Limit the number of open files of each child (0 is no limit)")
+	flag.StringVar(&umask, "umask", "", "Umask of the children, in octal, e.g. 027 (default mrun's)")
+	flag.DurationVar(&rlimit_cpu, "rlimit-cpu", 0, "Limit the CPU time of each child, rounded up to seconds (0 is no limit)")
+	flag.StringVar(&cgroup, "cgroup", "", "Run the children in this cgroup v2, a path below the cgroup2 mount, created if need be")
+	flag.StringVar(&cgroup_memory_max, "cgroup-memory-max", "", "Set memory.max of the -cgroup to this size, e.g. 1G")
+	flag.Float64Var(&cgroup_cpu_max, "cgroup-cpu-max", 0, "Set cpu.max of the -cgroup to this many CPUs, e.g. 1.5 (0 is no limit)")
+	flag.IntVar(&producer_nice, "producer-nice", 0, "Run the producer at this niceness, -20 to 19")
+	flag.IntVar(&consumer_nice, "consumer-nice", 0, "Run the consumer at this niceness, -20 to 19")
+	flag.BoolVar(&nice_required, "nice-required", false, "Don't start a child whose niceness can't be set, instead of running it at ours")
+	flag.IntVar(&producer_oom_score_adj, "producer-oom-score-adj", 0, "OOM score adjustment of the producer, -1000 to 1000, higher is killed first")
+	flag.IntVar(&consumer_oom_score_adj, "consumer-oom-score-adj", 0, "OOM score adjustment of the consumer, -1000 to 1000, higher is killed first")
+	flag.DurationVar(&producer_start_delay, "producer-start-delay", 0, "Wait this long before starting the producer the first time")
+	flag.DurationVar(&consumer_start_delay, "consumer-start-delay", 0, "Wait this long before starting the consumer the first time")
+	flag.BoolVar(&start_delay_on_restart, "start-delay-on-restart", false, "Wait for -producer-start-delay and -consumer-start-delay before every start, not just the first")
+	flag.StringVar(&stdin_file, "stdin-file", "", "Give the producer this file as its stdin, opened again for every start (- is mrun's stdin)")
+	flag.StringVar(&stdout_file, "stdout-file", "", "Write the output of the consumer to this file, reopened on SIGHUP (- is mrun's stdout)")
+	flag.BoolVar(&stdout_append, "stdout-append", false, "Append to -stdout-file instead of truncating it at startup")
+	flag.StringVar(&pipe_size, "pipe-size", "0", "Size of the pipes between the stages, e.g. 1M (0 keeps the system default)")
+	flag.BoolVar(&no_pgroup, "no-pgroup", false, "Keep the children in mrun's process group instead of giving each its own")
+	flag.BoolVar(&pump, "pump", false, "Copy the data between the stages through mrun, counting bytes and lines")
+	flag.BoolVar(&pty, "pty", false, "Make the producer's stdout a terminal, for programs that buffer or color their output depending on it, implies -pump")
+	flag.StringVar(&tee_file, "tee-file", "", "Also write the output of the producer to this file, reopened on SIGHUP, implies -pump")
+	flag.BoolVar(&tee_append, "tee-append", false, "Append to -tee-file instead of truncating it at startup")
+	flag.StringVar(&compress, "compress", "", "With -transport tcp, compress the stream to every reader with this, only gzip, decompressing it again for the consumer")
+	flag.BoolVar(&zdd, "zdd", false, "Have POST /restart replace the consumer without a gap, implies -pump")
+	flag.StringVar(&pump_buffer, "pump-buffer", "32K", "Read buffer size of -pump")
+	flag.DurationVar(&stall_timeout, "stall-timeout", 0, "With -pump, warn when a stage hasn't read its stdin for this long (0 never does)")
+	flag.BoolVar(&stall_restart, "stall-restart", false, "Also stop a stalled stage, restarting the pipeline")
+	flag.StringVar(&consumer_ready_cmd, "consumer-ready-cmd", "", "Only start the producer once this command exits 0, it is run until it does")
+	flag.DurationVar(&ready_timeout, "ready-timeout", 30*time.Second, "How long to wait for -consumer-ready-cmd to succeed (0 waits forever)")
+	flag.BoolVar(&spill, "spill", false, "With several consumers, or -pump and -independent-restart, keep the data a consumer or later stage misses while it is down on disk and replay it")
+	flag.StringVar(&spill_max, "spill-max-bytes", "64M", "Size of the -spill buffer of each consumer")
+	flag.StringVar(&spill_full, "spill-full", "drop", "What to do when a -spill buffer is full: drop the oldest data, or block the producer")
+	flag.StringVar(&balance, "balance", "", "With several consumers, give each line of the producer to one of them, roundrobin, instead of copying it to all")
+	flag.IntVar(&balance_buffer, "balance-buffer", 1000, "How many lines -balance keeps for each consumer")
+	flag.IntVar(&partition_by, "partition-by", 0, "With several consumers, give each line to one of them by a hash of this field, from 1, so the same key always goes to the same one")
+	flag.StringVar(&delimiter, "delimiter", "\t", "The character between the fields of -partition-by")
+	flag.StringVar(&balance_full, "balance-full", "skip", "What to do with a line for a consumer whose -balance buffer is full: skip to the next consumer, drop it, or block the producer")
+	flag.BoolVar(&capture_stderr, "capture-stderr", false, "Log the children's stderr line by line, prefixed with their role")
+	flag.StringVar(&producer_health_cmd, "producer-health-cmd", "", "Check that the producer is healthy with this command, run every -health-interval with MRUN_PID set")
+	flag.StringVar(&consumer_health_cmd, "consumer-health-cmd", "", "Check that the consumer is healthy with this command, run every -health-interval with MRUN_PID set")
+	flag.DurationVar(&health_interval, "health-interval", 10*time.Second, "How often to run the health checks, and how long each may take")
+	flag.IntVar(&health_retries, "health-retries", 3, "Stop a stage, as if it had failed, after this many failed health checks in a row")
+	flag.DurationVar(&run_timeout, "run-timeout", 0, "Stop a stage that is still running after this long and treat it as failed (0 is no limit)")
+	flag.BoolVar(&forward_signals, "forward-signals", false, "Relay SIGHUP, SIGINT and SIGTERM to the children instead of shutting down")
 	flag.BoolVar(&norestart, "norestart", false, "Do not restart a failed process, just quit")
-	flag.StringVar(&producer, "producer", "", "Path to producer run script")
-	flag.StringVar(&consumer, "consumer", "", "Path to consumer run script")
+	flag.StringVar(&transport, "transport", "pipe", "How the producer's output gets to the consumer: pipe, or tcp through -transport-addr")
+	flag.StringVar(&transport_addr, "transport-addr", "127.0.0.1:0", "Where to listen with -transport tcp, for the consumer and any other reader (port 0 picks one)")
+	flag.StringVar(&fifo, "fifo", "", "Connect the producer and the consumer through the named pipe at this path, created if missing")
+	flag.BoolVar(&fifo_keep, "fifo-keep", false, "Leave the -fifo in place when mrun exits, if it created it")
+	flag.DurationVar(&drain_timeout, "drain-timeout", 0, "On shutdown stop the producer first, and give the consumer this long to finish its input (0 stops both at once)")
+	flag.BoolVar(&bidirectional, "bidirectional", false, "Also pipe the consumer's stdout to the producer's stdin")
+	flag.BoolVar(&independent_restart, "independent-restart", false, "Restart only the stage that exited, on the same pipes, while the others keep running")
+	flag.StringVar(&producer_policy, "producer-policy", "", "restart or norestart when a producer exits, overriding -norestart")
+	flag.StringVar(&consumer_policy, "consumer-policy", "", "restart or norestart when a consumer exits, overriding -norestart")
+	flag.BoolVar(&once, "once", false, "Run the pipeline once, let every stage finish and exit with the consumer's status, or that of the first stage to fail")
+	flag.StringVar(&on_restart, "on-restart", "", "Run this command before restarting a stage that exited, with MRUN_ROLE and MRUN_EXIT set")
+	flag.BoolVar(&on_restart_required, "on-restart-required", false, "Give up instead of restarting if the -on-restart command fails")
+	flag.DurationVar(&hook_timeout, "hook-timeout", 0, "Kill the -on-restart command if it runs longer than this and restart anyway, 0 waits forever")
+	flag.StringVar(&pre_start, "pre-start", "", "Run this command once before starting the pipeline, and don't start it if the command fails")
+	flag.StringVar(&post_stop, "post-stop", "", "Run this command once after the pipeline has stopped for good")
+	flag.BoolVar(&stage_exit_codes, "stage-exit-codes", false, "With -norestart or -once, exit with 10 plus the position of the failed stage (10 for the producer, 11 for the consumer) instead of its exit code")
+	flag.BoolVar(&restart_on_failure, "restart-on-failure", false, "Only restart on a non-zero exit, shut down when the processes that exited all exited 0")
+	flag.BoolVar(&use_shell, "shell", false, "Run the producer, filter, consumer and stage values as shell command lines with -shell-path -c")
+	flag.StringVar(&shell_path, "shell-path", "/bin/sh", "Shell that runs the commands with -shell")
+	flag.Var(&producer_flags, "producer", "Path to producer run script, optionally followed by arguments (repeat to merge the output of several producers)")
+	flag.StringVar(&filter_spec, "filter", "", "Path to a filter run between the producer and the consumer, optionally followed by arguments")
+	flag.Var(&consumer_flags, "consumer", "Path to consumer run script, optionally followed by arguments (repeat to copy the producer's output to several consumers)")
+	flag.Var(&stage_flags, "stage", "A pipeline stage with optional arguments, repeat for each stage in order (replaces -producer and -consumer)")
+	flag.DurationVar(&restart_delay, "restart-delay", 0, "Fixed delay before restarting a failed pipeline")
+	flag.DurationVar(&backoff_base, "backoff-base", 100*time.Millisecond, "Initial delay between restart attempts")
+	flag.DurationVar(&backoff_max, "backoff-max", 30*time.Second, "Maximum delay between restart attempts")
+	flag.DurationVar(&min_healthy, "min-healthy", 10*time.Second, "Run time after which a stage is considered healthy, and the backoff and -max-restarts count reset when it exits")
+	flag.DurationVar(&min_healthy, "healthy-after", 10*time.Second, "Same as -min-healthy")
+	flag.IntVar(&max_restarts, "max-restarts", 0, "Give up after this many consecutive failed restarts (0 is unlimited)")
+	flag.BoolVar(&watch_files, "watch-files", false, "Restart a stage when its program changes on disk")
+	flag.StringVar(&restart_at, "restart-at", "", "Restart the pipeline every day at this local time, HH:MM")
+	flag.DurationVar(&restart_jitter, "restart-jitter", 0, "Delay the -restart-at restart by a random time up to this long")
+	flag.DurationVar(&max_runtime, "max-runtime", 0, "Shut the pipeline down gracefully and exit 0 after running this long (0 is no limit)")
+	flag.StringVar(&restart_rate_spec, "restart-rate", "", "Allow at most N restarts per window, e.g. 5/60s")
+	flag.DurationVar(&restart_rate_grace, "restart-rate-grace", 5*time.Minute, "Give up if the restart rate stays exceeded for this long")
+	flag.IntVar(&flap_threshold, "flap-threshold", 0, "Call the pipeline flapping after more than this many restarts within -flap-window (0 never does)")
+	flag.DurationVar(&flap_window, "flap-window", time.Minute, "Window of -flap-threshold")
+	flag.DurationVar(&flap_cooldown, "flap-cooldown", 5*time.Minute, "How long to wait before restarting a flapping pipeline")
 	flag.Parse()
 
-	format := logging.MustStringFormatter(
-		`%{time:2006-01-02 15:04:05.000-0700} %{level} [%{shortfile}] %{message}`,
-	)
-	stderrBackend := logging.NewLogBackend(os.Stderr, "", 0)
-	stderrFormatter := logging.NewBackendFormatter(stderrBackend, format)
-	stderrBackendLevelled := logging.AddModuleLevel(stderrFormatter)
-	logging.SetBackend(stderrBackendLevelled)
-	if debug {
-		stderrBackendLevelled.SetLevel(logging.DEBUG, "mrun")
-	} else {
-		stderrBackendLevelled.SetLevel(logging.INFO, "mrun")
+	if show_version {
+		print_version()
+		os.Exit(0)
 	}
-	log = logging.MustGetLogger("mrun")
 
-	if producer == "" || consumer == "" {
-		log.Error("The producer and consumer arguments are required")
-		flag.PrintDefaults()
+	if daemon_status != nil {
+		// Our stderr is the -logfile, which gets the log already.
+		log_stderr = false
+	}
+
+	if quiet && debug {
+		fmt.Fprintf(os.Stderr, "mrun: -quiet and -debug are mutually exclusive\n")
 		os.Exit(1)
-	} else {
-		var err error
-		producer, err = filepath.Abs(producer)
+	}
+	if err := setup_logging(); err != nil {
+		fmt.Fprintf(os.Stderr, "mrun: cannot set up logging: %v\n", err)
+		os.Exit(1)
+	}
+
+	var err error
+	for i, spec := range producer_flags {
+		path, args, err := resolve_command(spec, nil)
 		if err != nil {
-			panic(err)
+			log.Errorf("Bad producer: %v", err)
+			os.Exit(1)
+		}
+		if i == 0 {
+			producer, producer_args = path, args
+		} else {
+			more_producers = append(more_producers, supervisor.Stage{Path: path, Args: args})
 		}
-		log.Debugf("abs producer: %s", producer)
-		consumer, err = filepath.Abs(consumer)
+	}
+	for i, spec := range consumer_flags {
+		path, args, err := resolve_command(spec, nil)
 		if err != nil {
-			panic(err)
+			log.Errorf("Bad consumer: %v", err)
+			os.Exit(1)
+		}
+		if i == 0 {
+			consumer, consumer_args = path, args
+		} else {
+			more_consumers = append(more_consumers, supervisor.Stage{Path: path, Args: args})
 		}
-		log.Debugf("abs consumer: %s", consumer)
 	}
 
-	if norestart {
-		policy = NoRestart
+	if filter_spec != "" {
+		filter, filter_args, err = resolve_command(filter_spec, nil)
+		if err != nil {
+			log.Errorf("Bad filter: %v", err)
+			os.Exit(1)
+		}
 	}
-}
 
-func watch_producer(pipefds [2]int, comms chan uintptr) {
-	log.Debug("starting watch_producer")
-	readfd := pipefds[0]
-	writefd := pipefds[1]
-	for {
-		// Fork first process (writer - closes read end)
-		pid1, _, errno := syscall.RawSyscall(syscall.SYS_FORK, 0, 0, 0)
-		if errno != 0 {
-			log.Errorf("Failed to fork first process: %v", errno)
+	for _, spec := range stage_flags {
+		path, args, err := resolve_command(spec, nil)
+		if err != nil {
+			log.Errorf("Bad stage %q: %v", spec, err)
 			os.Exit(1)
 		}
+		stage_specs = append(stage_specs, supervisor.Stage{Path: path, Args: args})
+	}
 
-		if pid1 == 0 {
-			log.Debug("in first child")
-			// Child 1: writer process
-			// Close read end
-			syscall.Close(readfd)
-
-			// Set write end to non-blocking
-			flags, _ := unix.FcntlInt(uintptr(writefd), syscall.F_GETFL, 0)
-			unix.FcntlInt(uintptr(writefd), syscall.F_SETFL, flags|syscall.O_NONBLOCK)
-
-			// Redirect stdout to pipe write end
-			syscall.Dup2(writefd, syscall.Stdout)
-			syscall.Close(writefd)
-
-			// Exec into program (generates data)
-			//err := syscall.Exec("/bin/sh", []string{"sh", "-c", "echo 'Hello from writer'; seq 1 10"}, os.Environ())
-			log.Debugf("calling exec on %s", producer)
-			pname := filepath.Base(producer)
-			err := syscall.Exec(producer, []string{pname}, os.Environ())
-			if err != nil {
-				log.Errorf("Exec producer failed: %v", err)
-				os.Exit(1)
-			}
+	var cfg *Config
+	if config_path != "" {
+		cfg, err = load_config(config_path)
+		if err != nil {
+			log.Errorf("Bad config file: %v", err)
+			os.Exit(1)
 		}
-		comms <- pid1
-		go watch_consumer(pipefds, comms)
-
-		var status syscall.WaitStatus
-		syscall.Wait4(int(pid1), &status, 0, nil)
-		log.Infof("Writer process (PID %d) exited with status %d", pid1, status.ExitStatus())
+		if err := apply_config(cfg); err != nil {
+			log.Errorf("Bad config file %s: %v", config_path, err)
+			os.Exit(1)
+		}
+	}
 
-		comms <- 0
-		return
+	creds, err = supervisor.ResolveCredentials(run_user, run_group)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
 	}
-}
+	options.Credentials = creds
 
-func watch_consumer(pipefds [2]int, comms chan uintptr) {
-	log.Debug("starting watch_consumer")
-	readfd := pipefds[0]
-	writefd := pipefds[1]
-	for {
-		// Fork second process (reader - closes write end)
-		pid2, _, errno := syscall.RawSyscall(syscall.SYS_FORK, 0, 0, 0)
-		if errno != 0 {
-			log.Errorf("Failed to fork second process: %v", errno)
+	if cfg != nil && len(cfg.Pipelines) > 0 {
+		if err := check_pipeline_flags(); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		pipelines, err = build_pipelines(cfg)
+		if err != nil {
+			log.Errorf("Bad config file %s: %v", config_path, err)
+			os.Exit(1)
+		}
+	} else {
+		if len(stage_specs) == 0 && (producer == "" || consumer == "") {
+			log.Error("The producer and consumer arguments are required")
+			flag.PrintDefaults()
 			os.Exit(1)
 		}
 
-		if pid2 == 0 {
-			log.Debug("in second child")
-			// Child 2: reader process
-			// Close write end
-			syscall.Close(writefd)
+		if err := derive_settings(); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
 
-			// Set read end to non-blocking
-			flags, _ := unix.FcntlInt(uintptr(readfd), syscall.F_GETFL, 0)
-			unix.FcntlInt(uintptr(readfd), syscall.F_SETFL, flags|syscall.O_NONBLOCK)
+		// A typo would otherwise only show up as a child failing to
+		// start, over and over under the restart policy.
+		if !check_stages(stages) {
+			os.Exit(1)
+		}
+	}
 
-			// Redirect stdin from pipe read end
-			syscall.Dup2(readfd, syscall.Stdin)
-			syscall.Close(readfd)
+	if config_check {
+		log.Info("Configuration OK")
+		os.Exit(0)
+	}
+}
 
-			// Exec into program (reads data)
-			log.Debugf("calling exec on %s", consumer)
-			cname := filepath.Base(consumer)
-			err := syscall.Exec(consumer, []string{cname}, os.Environ())
-			if err != nil {
-				log.Errorf("Exec consumer failed: %v", err)
-				os.Exit(1)
-			}
+// derive_settings computes the supervisor options from the flags and
+// config values. It runs at startup and again on every reload.
+func derive_settings() error {
+	options.Policy = supervisor.Restart
+	if norestart {
+		options.Policy = supervisor.NoRestart
+	}
+	if once {
+		options.Policy = supervisor.Once
+	}
+	options.RestartOnFailure = restart_on_failure
+	options.CaptureStderr = capture_stderr
+	options.NoProcessGroup = no_pgroup
+	size, err := parse_size(pipe_size)
+	if err != nil || size > math.MaxInt32 {
+		return fmt.Errorf("bad -pipe-size %q", pipe_size)
+	}
+	options.PipeSize = int(size)
+	options.Pump = pump || zdd || pty || tee_file != ""
+	switch compress {
+	case "", "gzip":
+		options.Compress = compress
+	default:
+		return fmt.Errorf("bad -compress %q, it can only be gzip", compress)
+	}
+	options.Pty = pty
+	options.ZeroDowntime = zdd
+	options.IndependentRestart = independent_restart
+	options.Bidirectional = bidirectional
+	options.TCPAddr = ""
+	switch transport {
+	case "pipe":
+	case "tcp":
+		options.TCPAddr = transport_addr
+	default:
+		return fmt.Errorf("-transport must be pipe or tcp, not %q", transport)
+	}
+	options.FIFO = fifo
+	options.DrainTimeout = drain_timeout
+	options.KeepFIFO = fifo_keep
+	size, err = parse_size(pump_buffer)
+	if err != nil || size <= 0 || size > math.MaxInt32 {
+		return fmt.Errorf("bad -pump-buffer %q", pump_buffer)
+	}
+	options.PumpBuffer = int(size)
+	options.Spill = spill
+	options.SpillMax, err = parse_size(spill_max)
+	if err != nil || options.SpillMax <= 0 {
+		return fmt.Errorf("bad -spill-max-bytes %q", spill_max)
+	}
+	switch spill_full {
+	case "drop", "block":
+		options.SpillBlock = spill_full == "block"
+	default:
+		return fmt.Errorf("-spill-full must be drop or block, not %q", spill_full)
+	}
+	switch balance {
+	case "", "roundrobin":
+		options.Balance = balance != ""
+	default:
+		return fmt.Errorf("bad -balance %q, it can only be roundrobin", balance)
+	}
+	if balance_buffer <= 0 {
+		return fmt.Errorf("-balance-buffer must be positive")
+	}
+	if partition_by < 0 {
+		return fmt.Errorf("-partition-by counts fields from 1")
+	}
+	if partition_by > 0 {
+		if options.Balance {
+			return fmt.Errorf("use either -balance or -partition-by, not both")
+		}
+		if delimiter == `\t` {
+			delimiter = "\t"
+		}
+		if len(delimiter) != 1 {
+			return fmt.Errorf("-delimiter must be a single character, not %q", delimiter)
+		}
+		options.Balance = true
+		options.PartitionDelimiter = delimiter[0]
+	}
+	options.PartitionBy = partition_by
+	options.BalanceBuffer = balance_buffer
+	switch balance_full {
+	case "skip":
+		options.BalanceWhenFull = supervisor.BalanceSkip
+	case "drop":
+		options.BalanceWhenFull = supervisor.BalanceDrop
+	case "block":
+		options.BalanceWhenFull = supervisor.BalanceBlock
+	default:
+		return fmt.Errorf("-balance-full must be skip, drop or block, not %q", balance_full)
+	}
+	if stall_timeout > 0 && !options.Pump {
+		return fmt.Errorf("-stall-timeout needs -pump")
+	}
+	options.StallTimeout = stall_timeout
+	options.StallRestart = stall_restart
+	if options.ReadyCommand, err = command_flag("consumer-ready-cmd", consumer_ready_cmd); err != nil {
+		return err
+	}
+	options.ReadyTimeout = ready_timeout
+	options.PidsFile = pids_file
+	if options.OnRestart, err = command_flag("on-restart", on_restart); err != nil {
+		return err
+	}
+	if options.PreStart, err = command_flag("pre-start", pre_start); err != nil {
+		return err
+	}
+	if options.PostStop, err = command_flag("post-stop", post_stop); err != nil {
+		return err
+	}
+	options.OnRestartRequired = on_restart_required
+	options.HookTimeout = hook_timeout
+
+	var file_env []string
+	if env_file != "" {
+		if file_env, err = read_env_file(env_file); err != nil {
+			return fmt.Errorf("bad -env-file: %v", err)
+		}
+	}
+	options.Env = merge_env(base_env(), slices.Concat([]string{"MRUN_VERSION=" + version}, config_env, file_env, env_overrides))
+
+	options.RestartRate = supervisor.RateLimit{}
+	if restart_rate_spec != "" {
+		rate, err := supervisor.ParseRate(restart_rate_spec)
+		if err != nil {
+			return err
+		}
+		options.RestartRate = rate
+	}
+	options.RestartRateGrace = restart_rate_grace
+	if flap_threshold < 0 || flap_window <= 0 || flap_cooldown < 0 {
+		return fmt.Errorf("-flap-threshold, -flap-window and -flap-cooldown can't be negative")
+	}
+	if max_runtime < 0 {
+		return fmt.Errorf("-max-runtime can't be negative")
+	}
+	if restart_at != "" {
+		if _, _, err := parse_time_of_day(restart_at); err != nil {
+			return fmt.Errorf("bad -restart-at: %v", err)
 		}
-		comms <- pid2
+	}
+	if restart_jitter < 0 || restart_jitter >= 24*time.Hour {
+		return fmt.Errorf("-restart-jitter must be at least 0 and less than a day")
+	}
+	options.FlapThreshold = flap_threshold
+	options.FlapWindow = flap_window
+	options.FlapCooldown = flap_cooldown
+	options.RestartDelay = restart_delay
+	options.BackoffBase = backoff_base
+	options.BackoffMax = backoff_max
+	options.MinHealthy = min_healthy
+	options.MaxRestarts = max_restarts
+	if options.StopSignal, err = parse_signal(stop_signal); err != nil {
+		return fmt.Errorf("bad -stop-signal: %v", err)
+	}
+	options.StopTimeout = stop_timeout
+	if options.Rlimits, err = rlimits(); err != nil {
+		return err
+	}
+	options.Umask = nil
+	if umask != "" {
+		mask, err := strconv.ParseUint(umask, 8, 32)
+		if err != nil || mask > 0o777 {
+			return fmt.Errorf("bad -umask %q, expected an octal mode like 027", umask)
+		}
+		options.Umask = new(int)
+		*options.Umask = int(mask)
+		log.Infof("Running the children with umask %04o", mask)
+	}
+	options.Cgroup = cgroup
+	options.CgroupMemoryMax = 0
+	if cgroup_memory_max != "" {
+		size, err := parse_size(cgroup_memory_max)
+		if err != nil {
+			return fmt.Errorf("bad -cgroup-memory-max %q", cgroup_memory_max)
+		}
+		options.CgroupMemoryMax = uint64(size)
+	}
+	options.CgroupCPUMax = cgroup_cpu_max
+	options.RunTimeout = run_timeout
+
+	if err := build_stages(); err != nil {
+		return err
+	}
+	for _, stage := range stages {
+		log.Debugf("%s: %s %v", stage.Role, stage.Path, stage.Args)
+	}
+	options.Stages = stages
+	options.Topology = supervisor.Linear
+	if options.StagePolicies, err = stage_policies(); err != nil {
+		return err
+	}
+	if err := set_nice(); err != nil {
+		return err
+	}
+	options.NiceRequired = nice_required
+	if err := set_oom_score_adj(); err != nil {
+		return err
+	}
+	if err := set_health_commands(); err != nil {
+		return err
+	}
+	if err := set_start_delays(); err != nil {
+		return err
+	}
+	options.StartDelayOnRestart = start_delay_on_restart
+	if err := set_stdin_file(); err != nil {
+		return err
+	}
+	if err := open_stdout_file(); err != nil {
+		return err
+	}
+	if err := open_tee_file(); err != nil {
+		return err
+	}
+	if health_interval <= 0 || health_retries <= 0 {
+		return fmt.Errorf("-health-interval and -health-retries must be positive")
+	}
+	options.HealthInterval = health_interval
+	options.HealthRetries = health_retries
+	if bidirectional && (len(stages) != 2 || fan_out || fan_in || options.Pump) {
+		return fmt.Errorf("-bidirectional needs a single producer and consumer, and no -pump")
+	}
+	if options.TCPAddr != "" && (len(stages) != 2 || fan_out || fan_in || options.Pump || bidirectional || independent_restart) {
+		return fmt.Errorf("-transport tcp needs a single producer and consumer, and no -pump, -bidirectional or -independent-restart")
+	}
+	if compress != "" && options.TCPAddr == "" {
+		return fmt.Errorf("-compress needs -transport tcp")
+	}
+	if fifo != "" && (len(stages) != 2 || fan_out || fan_in || options.Pump || bidirectional || options.TCPAddr != "") {
+		return fmt.Errorf("-fifo needs a single producer and consumer, and no -pump, -bidirectional or -transport tcp")
+	}
+	if drain_timeout < 0 {
+		return fmt.Errorf("-drain-timeout can't be negative")
+	}
+	if drain_timeout > 0 && (fan_in || independent_restart) {
+		return fmt.Errorf("-drain-timeout doesn't go with several producers or -independent-restart")
+	}
+	if spill && !fan_out && !(options.Pump && independent_restart && !fan_in) {
+		return fmt.Errorf("-spill needs several consumers, or -pump with -independent-restart")
+	}
+	if options.Balance && (!fan_out || spill) {
+		return fmt.Errorf("-balance and -partition-by need several consumers, and no -spill")
+	}
+	if fan_out {
+		options.Topology = supervisor.FanOut
+	} else if fan_in {
+		options.Topology = supervisor.FanIn
+	}
+	return nil
+}
 
-		var status syscall.WaitStatus
-		syscall.Wait4(int(pid2), &status, 0, nil)
-		log.Infof("Reader process (PID %d) exited with status %d", pid2, status.ExitStatus())
+// rlimits returns the resource limits of the children from the -rlimit
+// flags.
+func rlimits() ([]supervisor.Rlimit, error) {
+	var limits []supervisor.Rlimit
+	if rlimit_as != "" {
+		size, err := parse_size(rlimit_as)
+		if err != nil || size == 0 {
+			return nil, fmt.Errorf("bad -rlimit-as %q", rlimit_as)
+		}
+		limits = append(limits, supervisor.Rlimit{Resource: unix.RLIMIT_AS, Max: uint64(size)})
+	}
+	if rlimit_nofile < 0 {
+		return nil, fmt.Errorf("bad -rlimit-nofile %d", rlimit_nofile)
+	} else if rlimit_nofile > 0 {
+		limits = append(limits, supervisor.Rlimit{Resource: unix.RLIMIT_NOFILE, Max: uint64(rlimit_nofile)})
+	}
+	if rlimit_cpu < 0 {
+		return nil, fmt.Errorf("bad -rlimit-cpu %v", rlimit_cpu)
+	} else if rlimit_cpu > 0 {
+		seconds := uint64((rlimit_cpu + time.Second - 1) / time.Second)
+		limits = append(limits, supervisor.Rlimit{Resource: unix.RLIMIT_CPU, Max: seconds})
+	}
+	return limits, nil
+}
 
-		comms <- 0
-		return
+// command_flag splits the command line given to the -name flag, nil if it
+// is empty.
+func command_flag(name string, cmdline string) ([]string, error) {
+	if cmdline == "" {
+		return nil, nil
+	}
+	words, err := split_args(cmdline)
+	if err != nil || len(words) == 0 {
+		return nil, fmt.Errorf("bad -%s %q", name, cmdline)
 	}
+	return words, nil
 }
 
-func main() {
-	sigs := make(chan os.Signal, 1)
+// resolve_command splits a -producer/-consumer value into the absolute
+// script path and its arguments, with extra appended to the arguments.
+// With -shell the value is a shell command line instead, run by
+// -shell-path with extra quoted onto its end.
+func resolve_command(cmdline string, extra []string) (string, []string, error) {
+	if use_shell {
+		if strings.TrimSpace(cmdline) == "" {
+			return "", nil, fmt.Errorf("empty command")
+		}
+		path, err := filepath.Abs(shell_path)
+		if err != nil {
+			return "", nil, err
+		}
+		for _, arg := range extra {
+			cmdline += " " + shell_quote(arg)
+		}
+		return path, []string{"-c", cmdline}, nil
+	}
+	path, args, err := parse_command(cmdline)
+	if err != nil {
+		return "", nil, err
+	}
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return "", nil, err
+	}
+	return path, append(args, extra...), nil
+}
 
-	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+// parse_command splits a -producer/-consumer value into the script path
+// and its arguments.
+func parse_command(cmdline string) (string, []string, error) {
+	words, err := split_args(cmdline)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(words) == 0 {
+		return "", nil, fmt.Errorf("empty command")
+	}
+	return words[0], words[1:], nil
+}
 
-	// Start signal handler
-	go func() {
-		sig := <-sigs
-		switch sig {
-		case syscall.SIGHUP:
-			log.Warning("SIGHUP")
-			shutdown_asap = true
-		case syscall.SIGINT:
-			log.Warning("SIGINT")
-			shutdown_asap = true
-		case syscall.SIGTERM:
-			log.Warning("SIGTERM")
-			shutdown_asap = true
-		default:
-			log.Debug("unknown signal")
+// exit_code maps the error from Run to mrun's exit code.
+func exit_code(err error) int {
+	var exit *supervisor.ExitError
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &exit):
+		if stage_exit_codes {
+			return 10 + exit.Index
 		}
-	}()
+		return exit.ExitCode()
+	case errors.Is(err, supervisor.ErrMaxRestarts):
+		return ExitMaxRestarts
+	case errors.Is(err, supervisor.ErrRateLimited):
+		return ExitRateLimited
+	}
+	log.Error(err)
+	return 1
+}
 
+// goroutine_stacks returns the stack traces of all goroutines.
+func goroutine_stacks() []byte {
+	buf := make([]byte, 64*1024)
 	for {
-		if shutdown_asap {
-			break
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return buf[:n]
 		}
-		comms := make(chan uintptr)
-		// Create pipe
-		pipefds := [2]int{}
-		err := syscall.Pipe(pipefds[:])
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+// quit cleans up after mrun itself and exits with code.
+func quit(code int) {
+	notify_stopping()
+	stop_control()
+	stop_control_socket()
+	stop_metrics()
+	stop_events()
+	stop_webhook()
+	stop_tracing()
+	remove_pidfile()
+	os.Exit(code)
+}
+
+func main() {
+	cloexec_inherited()
+
+	var err error
+	for _, p := range pipelines {
+		p.sup, err = supervisor.New(p.options)
 		if err != nil {
-			log.Errorf("Failed to create pipe: %v", err)
+			log.Errorf("Pipeline %s: %v", p.name, err)
 			os.Exit(1)
 		}
+	}
+	if len(pipelines) == 0 {
+		sup, err = supervisor.New(options)
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+	}
+
+	if daemonize && daemon_status == nil {
+		start_daemon()
+	}
+
+	if pidfile != "" {
+		if err := write_pidfile(pidfile); err != nil {
+			log.Errorf("Cannot write pidfile: %v", err)
+			os.Exit(1)
+		}
+	}
 
-		readfd := pipefds[0]
-		writefd := pipefds[1]
+	if metrics_addr != "" {
+		if err := start_metrics(metrics_addr); err != nil {
+			log.Errorf("Cannot start metrics server: %v", err)
+			quit(1)
+		}
+	}
 
-		log.Debugf("Created pipe: read=%d, write=%d", readfd, writefd)
+	if statsd_addr != "" {
+		if err := start_statsd(statsd_addr, statsd_prefix); err != nil {
+			log.Errorf("Cannot send metrics to StatsD: %v", err)
+			quit(1)
+		}
+	}
 
-		go watch_producer(pipefds, comms)
+	if control_addr != "" {
+		if err := start_control(control_addr); err != nil {
+			log.Errorf("Cannot start control server: %v", err)
+			quit(1)
+		}
+	}
 
-		log.Debug("main: top of for loop")
-		// producer ready
-		pid1 := <- comms
-		log.Debugf("pid1: %d", pid1)
-		// consumer ready
-		pid2 := <- comms
-		log.Debugf("pid2: %d", pid2)
+	if control_socket != "" {
+		if err := start_control_socket(control_socket); err != nil {
+			log.Errorf("Cannot serve the control socket: %v", err)
+			quit(1)
+		}
+	}
 
-		// Parent: close both ends, but not until both children
-		// have forked.
-		syscall.Close(readfd)
-		syscall.Close(writefd)
+	if events_file != "" {
+		if err := open_events_file(events_file); err != nil {
+			log.Errorf("Cannot open the events file: %v", err)
+			quit(1)
+		}
+	}
 
-		// Block on either goroutine quitting.
-		<-comms
-		log.Errorf("watch routine exited")
-		syscall.Kill(int(pid1), syscall.SIGTERM)
-		syscall.Kill(int(pid2), syscall.SIGTERM)
+	if webhook_url != "" {
+		if err := start_webhook(webhook_url); err != nil {
+			log.Errorf("Bad -webhook-url: %v", err)
+			quit(1)
+		}
+	}
 
-		if policy != Restart {
-			os.Exit(1)
+	if len(pipelines) == 0 {
+		start_tracing(otel_endpoint)
+	} else if trace_url("") != "" {
+		log.Warning("Not sending traces, that isn't supported with several pipelines")
+	}
+
+	start_events()
+
+	if restart_at != "" {
+		schedule_restarts()
+	}
+
+	if watch_files {
+		if err := start_watching(); err != nil {
+			log.Errorf("Cannot watch the programs: %v", err)
+			quit(1)
+		}
+	}
+
+	start_notify()
+	notify_daemonizer()
+
+	sigs := make(chan os.Signal, 1)
+
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGQUIT, syscall.SIGWINCH)
+
+	// Fires once -max-runtime is up, which ends the run like a SIGTERM
+	// but with exit code 0.
+	var deadline <-chan time.Time
+	if max_runtime > 0 {
+		deadline = time.After(max_runtime)
+	}
+	var out_of_time atomic.Bool
+
+	// Start signal handler. A SIGHUP reload doesn't end the program, so
+	// keep handling signals for as long as we run.
+	go func() {
+		stopping := false
+		for {
+			var sig os.Signal
+			select {
+			case <-deadline:
+				log.Warningf("Ran for -max-runtime %v, shutting down", max_runtime)
+				out_of_time.Store(true)
+				stopping = true
+				stopping_because("max_runtime")
+				notify_stopping()
+				stop_all()
+				continue
+			case done := <-reload_requests:
+				notify_reloading()
+				done <- reload()
+				sd_notify("READY=1")
+				continue
+			case sig = <-sigs:
+			}
+			if sig == syscall.SIGUSR2 {
+				reopen_logfile()
+				reopen_output_files()
+				continue
+			}
+			if sig == syscall.SIGWINCH {
+				for _, s := range supervisors() {
+					s.Resize()
+				}
+				continue
+			}
+			if sig == syscall.SIGUSR1 {
+				// Status waits for the supervision loop, don't hold
+				// up the other signals meanwhile.
+				go log_status()
+				continue
+			}
+			if sig == syscall.SIGQUIT {
+				// For looking into a stuck pipeline.
+				log.Warningf("SIGQUIT, shutting down\n%s", goroutine_stacks())
+				stopping = true
+				stopping_because("signal")
+				notify_stopping()
+				stop_all()
+				continue
+			}
+			if forward_signals {
+				log.Warningf("%v, forwarding to children", sig)
+				for _, s := range supervisors() {
+					s.Signal(sig.(syscall.Signal))
+				}
+				if sig != syscall.SIGHUP {
+					stopping_because("signal")
+					notify_stopping()
+					for _, s := range supervisors() {
+						s.Drain()
+					}
+				}
+				continue
+			}
+			switch sig {
+			case syscall.SIGHUP:
+				log.Warning("SIGHUP")
+				notify_reloading()
+				reopen_logfile()
+				reopen_output_files()
+				if err := reload(); err != nil {
+					log.Errorf("Reload failed: %v", err)
+				}
+				sd_notify("READY=1")
+			case syscall.SIGINT, syscall.SIGTERM:
+				// A second one, e.g. another Ctrl-C, doesn't wait for
+				// the children any longer.
+				if stopping {
+					log.Warningf("%s again, killing the children", unix.SignalName(sig.(syscall.Signal)))
+					for _, s := range supervisors() {
+						s.Signal(syscall.SIGKILL)
+					}
+					continue
+				}
+				log.Warning(unix.SignalName(sig.(syscall.Signal)))
+				stopping = true
+				stopping_because("signal")
+				notify_stopping()
+				stop_all()
+			default:
+				log.Debug("unknown signal")
+			}
 		}
+	}()
+
+	results, code := run_all()
+	if out_of_time.Load() {
+		code = 0
 	}
+	log_summary(results, code)
+	quit(code)
 }
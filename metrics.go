@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+var metrics_server *http.Server
+
+// start_metrics serves the metrics on addr at /metrics. The listen
+// happens here so that a bad address is reported at startup.
+func start_metrics(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		write_metrics(w)
+	})
+	metrics_server = &http.Server{Handler: mux}
+	go func() {
+		if err := metrics_server.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Errorf("Metrics server failed: %v", err)
+		}
+	}()
+	log.Infof("Serving metrics on http://%s/metrics", l.Addr())
+	return nil
+}
+
+// stop_metrics shuts the metrics server down, if it is running.
+func stop_metrics() {
+	if metrics_server == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	metrics_server.Shutdown(ctx)
+	metrics_server = nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+var stopping_once sync.Once
+
+// sd_notify sends state to systemd, if we were started by it with
+// Type=notify; otherwise NOTIFY_SOCKET is unset and it does nothing.
+func sd_notify(state string) {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return
+	}
+	// A leading @ means an abstract socket.
+	if path[0] == '@' {
+		path = "\x00" + path[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		log.Warningf("Cannot notify systemd: %v", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Warningf("Cannot notify systemd: %v", err)
+	}
+}
+
+// start_notify tells systemd once the pipeline is up, and pings its
+// watchdog for as long as every stage is running, if it asked for that
+// with WATCHDOG_USEC.
+func start_notify() {
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return
+	}
+	go func() {
+		<-all_ready()
+		sd_notify("READY=1")
+	}()
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	// Ping twice per interval, as systemd recommends.
+	interval := time.Duration(usec) * time.Microsecond / 2
+	log.Debugf("Pinging the systemd watchdog every %v", interval)
+	go func() {
+		for range time.Tick(interval) {
+			if all_healthy() {
+				sd_notify("WATCHDOG=1")
+			}
+		}
+	}()
+}
+
+// notify_reloading tells systemd that we are reloading; READY=1 follows
+// once done. Newer versions want the time too.
+func notify_reloading() {
+	var now unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &now); err != nil {
+		sd_notify("RELOADING=1")
+		return
+	}
+	sd_notify(fmt.Sprintf("RELOADING=1\nMONOTONIC_USEC=%d", now.Nano()/1000))
+}
+
+// notify_stopping tells systemd that we are shutting down, once.
+func notify_stopping() {
+	stopping_once.Do(func() { sd_notify("STOPPING=1") })
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// The files of -stdout-file and -tee-file, nil without. The data goes
+// to them through mrun, so that they can be reopened while the stages
+// run.
+var (
+	stdout_writer *RotatingFile
+	tee_writer    *RotatingFile
+)
+
+// open_output_file opens path to write to, truncating it first unless
+// appending is set.
+func open_output_file(path string, appending bool) (*RotatingFile, error) {
+	if !appending {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return nil, err
+		}
+		f.Close()
+	}
+	return open_rotating_file(path, 0, 0)
+}
+
+// open_stdout_file opens -stdout-file, once, and makes it the
+// supervisor's Stdout.
+func open_stdout_file() error {
+	if stdout_file == "" || stdout_file == "-" {
+		return nil
+	}
+	if bidirectional {
+		return fmt.Errorf("-stdout-file can't be used with -bidirectional, the consumer writes to the producer")
+	}
+	if stdout_writer == nil {
+		w, err := open_output_file(stdout_file, stdout_append)
+		if err != nil {
+			return fmt.Errorf("bad -stdout-file: %v", err)
+		}
+		stdout_writer = w
+	}
+	options.Stdout = stdout_writer
+	return nil
+}
+
+// open_tee_file opens -tee-file, once, and makes it the supervisor's
+// Tee.
+func open_tee_file() error {
+	if tee_file == "" {
+		return nil
+	}
+	if tee_writer == nil {
+		w, err := open_output_file(tee_file, tee_append)
+		if err != nil {
+			return fmt.Errorf("bad -tee-file: %v", err)
+		}
+		tee_writer = w
+	}
+	options.Tee = tee_writer
+	return nil
+}
+
+// reopen_output_files reopens -stdout-file and -tee-file after external
+// rotation.
+func reopen_output_files() {
+	for _, f := range []struct {
+		path string
+		w    *RotatingFile
+	}{{stdout_file, stdout_writer}, {tee_file, tee_writer}} {
+		if f.w == nil {
+			continue
+		}
+		if err := f.w.Reopen(); err != nil {
+			log.Errorf("Cannot reopen %s: %v", f.path, err)
+			continue
+		}
+		log.Infof("Reopened %s", f.path)
+	}
+}
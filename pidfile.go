@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// process_alive reports whether pid refers to a running process.
+func process_alive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// write_pidfile atomically writes our PID to path. It refuses to replace
+// a pidfile that belongs to another live process.
+func write_pidfile(path string) error {
+	if data, err := os.ReadFile(path); err == nil {
+		pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err == nil && pid > 0 && pid != os.Getpid() && process_alive(pid) {
+			return fmt.Errorf("%s: already running as PID %d", path, pid)
+		}
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := fmt.Fprintf(tmp, "%d\n", os.Getpid()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// remove_pidfile removes the pidfile, if we wrote one.
+func remove_pidfile() {
+	if pidfile == "" {
+		return
+	}
+	if err := os.Remove(pidfile); err != nil && !os.IsNotExist(err) {
+		log.Warningf("Failed to remove pidfile %s: %v", pidfile, err)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/msoulier/mrun/supervisor"
+)
+
+// pipeline is one entry of the pipelines list of the config file. Each
+// runs under a supervisor of its own, side by side with the others.
+type pipeline struct {
+	name    string
+	options supervisor.Options
+	sup     *supervisor.Supervisor
+}
+
+// The pipelines of the config file, nil when there is only sup.
+var pipelines []*pipeline
+
+// pipeline_settings are the globals apply_pipeline_config sets, kept so
+// that every pipeline starts out from the same ones.
+type pipeline_settings struct {
+	producer, consumer, filter                string
+	producer_args, consumer_args, filter_args []string
+	stage_specs                               []supervisor.Stage
+	config_env                                []string
+	norestart, restart_on_failure             bool
+	max_restarts                              int
+	restart_rate_spec                         string
+	restart_delay, backoff_base, backoff_max  time.Duration
+	min_healthy                               time.Duration
+}
+
+func save_pipeline_settings() pipeline_settings {
+	return pipeline_settings{
+		producer, consumer, filter,
+		producer_args, consumer_args, filter_args,
+		stage_specs,
+		config_env,
+		norestart, restart_on_failure,
+		max_restarts,
+		restart_rate_spec,
+		restart_delay, backoff_base, backoff_max,
+		min_healthy,
+	}
+}
+
+func (ps pipeline_settings) restore() {
+	producer, consumer, filter = ps.producer, ps.consumer, ps.filter
+	producer_args, consumer_args, filter_args = ps.producer_args, ps.consumer_args, ps.filter_args
+	stage_specs = ps.stage_specs
+	config_env = ps.config_env
+	norestart, restart_on_failure = ps.norestart, ps.restart_on_failure
+	max_restarts = ps.max_restarts
+	restart_rate_spec = ps.restart_rate_spec
+	restart_delay, backoff_base, backoff_max = ps.restart_delay, ps.backoff_base, ps.backoff_max
+	min_healthy = ps.min_healthy
+}
+
+// build_pipelines works out the options of each of the pipelines of cfg,
+// whose top level settings have to be applied already. The command line
+// wins over the settings of a pipeline, which win over those of the top
+// level. The globals are left as they were.
+func build_pipelines(cfg *Config) ([]*pipeline, error) {
+	saved := save_pipeline_settings()
+	defer saved.restore()
+	var built []*pipeline
+	for _, named := range cfg.Pipelines {
+		saved.restore()
+		pc := named.PipelineConfig
+		pc.Env = maps.Clone(cfg.Env)
+		if pc.Env == nil {
+			pc.Env = make(map[string]string)
+		}
+		maps.Copy(pc.Env, named.Env)
+		if err := apply_pipeline_config(&pc); err != nil {
+			return nil, fmt.Errorf("pipeline %s: %v", named.Name, err)
+		}
+		if err := derive_settings(); err != nil {
+			return nil, fmt.Errorf("pipeline %s: %v", named.Name, err)
+		}
+		if !check_stages(stages) {
+			return nil, fmt.Errorf("pipeline %s: a stage can't be run", named.Name)
+		}
+		opts := options
+		opts.Env = append(slices.Clip(opts.Env), "MRUN_PIPELINE="+named.Name)
+		built = append(built, &pipeline{name: named.Name, options: opts})
+	}
+	return built, nil
+}
+
+// check_pipeline_flags refuses the flags that are about a single
+// pipeline, when running those of the config file.
+func check_pipeline_flags() error {
+	for _, name := range []string{"producer", "consumer", "filter", "stage"} {
+		if flag_set(name) {
+			return fmt.Errorf("-%s can't be used with the pipelines of a config file", name)
+		}
+	}
+	for _, f := range []struct {
+		name string
+		set  bool
+	}{
+		{"pids-file", pids_file != ""},
+		{"cgroup", cgroup != ""},
+		{"events-file", events_file != ""},
+		{"webhook-url", webhook_url != ""},
+		{"otel-endpoint", otel_endpoint != ""},
+		{"statsd-addr", statsd_addr != ""},
+		{"watch-files", watch_files},
+		{"restart-at", restart_at != ""},
+		{"stdout-file", stdout_file != "" && stdout_file != "-"},
+		{"tee-file", tee_file != ""},
+	} {
+		if f.set {
+			return fmt.Errorf("-%s isn't supported with several pipelines", f.name)
+		}
+	}
+	return nil
+}
+
+// supervisors returns every supervisor mrun runs.
+func supervisors() []*supervisor.Supervisor {
+	if len(pipelines) == 0 {
+		return []*supervisor.Supervisor{sup}
+	}
+	all := make([]*supervisor.Supervisor, len(pipelines))
+	for i, p := range pipelines {
+		all[i] = p.sup
+	}
+	return all
+}
+
+// stop_all stops every pipeline gracefully.
+func stop_all() {
+	for _, s := range supervisors() {
+		s.Stop()
+	}
+}
+
+// all_ready returns a channel that is closed once every pipeline has
+// been up.
+func all_ready() <-chan struct{} {
+	ready := make(chan struct{})
+	go func() {
+		for _, s := range supervisors() {
+			<-s.Ready()
+		}
+		close(ready)
+	}()
+	return ready
+}
+
+// all_healthy reports whether every pipeline has all its stages running.
+func all_healthy() bool {
+	for _, s := range supervisors() {
+		if !s.Healthy() {
+			return false
+		}
+	}
+	return true
+}
+
+// pipelines_status is the status of every pipeline, by name.
+type pipelines_status struct {
+	Pipelines map[string]*supervisor.Status `json:"pipelines"`
+}
+
+// status returns the status of the pipeline, or of every pipeline.
+func status() (any, error) {
+	if len(pipelines) == 0 {
+		return sup.Status()
+	}
+	all := pipelines_status{make(map[string]*supervisor.Status)}
+	for _, p := range pipelines {
+		s, err := p.sup.Status()
+		if err != nil {
+			return nil, fmt.Errorf("pipeline %s: %v", p.name, err)
+		}
+		all.Pipelines[p.name] = s
+	}
+	return all, nil
+}
+
+// restart restarts the pipeline called name, or every pipeline if name
+// is empty.
+func restart(name string) error {
+	if len(pipelines) == 0 {
+		if name != "" {
+			return fmt.Errorf("there is no pipeline %s, only one without a name", name)
+		}
+		return sup.Restart()
+	}
+	var errs []error
+	for _, p := range pipelines {
+		if name != "" && p.name != name {
+			continue
+		}
+		if err := p.sup.Restart(); err != nil {
+			errs = append(errs, fmt.Errorf("pipeline %s: %v", p.name, err))
+		}
+		if name != "" {
+			return errors.Join(errs...)
+		}
+	}
+	if name != "" {
+		return fmt.Errorf("there is no pipeline %s", name)
+	}
+	return errors.Join(errs...)
+}
+
+// write_metrics writes the metrics of the pipeline, or of every pipeline
+// with a pipeline label.
+func write_metrics(w io.Writer) {
+	if len(pipelines) == 0 {
+		sup.Metrics().WriteText(w)
+		return
+	}
+	metrics := make(map[string]*supervisor.Metrics)
+	for _, p := range pipelines {
+		metrics[p.name] = p.sup.Metrics()
+	}
+	supervisor.WriteLabeledText(w, "pipeline", metrics)
+}
+
+// run_all runs the pipeline, or every pipeline until the last one has
+// stopped, and returns how each ended and the exit code: that of the
+// first pipeline that failed, if any did.
+func run_all() ([]run_result, int) {
+	if len(pipelines) == 0 {
+		err := sup.Run(context.Background())
+		code := exit_code(err)
+		return []run_result{{err, code}}, code
+	}
+	results := make([]run_result, len(pipelines))
+	var wg sync.WaitGroup
+	for i, p := range pipelines {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			log.Infof("Starting pipeline %s", p.name)
+			err := p.sup.Run(context.Background())
+			results[i] = run_result{err, exit_code(err)}
+			log.Infof("Pipeline %s stopped, exit code %d", p.name, results[i].code)
+		}()
+	}
+	wg.Wait()
+	for _, result := range results {
+		if result.code != 0 {
+			return results, result.code
+		}
+	}
+	return results, 0
+}
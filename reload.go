@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/msoulier/mrun/supervisor"
+)
+
+// Reloads asked for other than by SIGHUP, handed to the signal handler
+// so that they never run at the same time as one. The handler sends the
+// result on the channel it receives, which must be buffered.
+var reload_requests = make(chan chan error)
+
+// request_reload reloads through the signal handler and returns the
+// result.
+func request_reload() error {
+	done := make(chan error, 1)
+	reload_requests <- done
+	return <-done
+}
+
+// reload rereads the config file and hands the new settings to the
+// supervisor. They only take effect at the next restart, the running
+// pipeline is left alone.
+func reload() error {
+	if config_path == "" {
+		return errors.New("no config file in use, nothing to reload")
+	}
+	cfg, err := load_config(config_path)
+	if err != nil {
+		return fmt.Errorf("%v, keeping the current settings", err)
+	}
+	if cfg.Pidfile != "" && cfg.Pidfile != pidfile && !flag_set("pidfile") {
+		log.Warningf("pidfile can't be changed while running, still using %s", pidfile)
+		cfg.Pidfile = pidfile
+	}
+	if (len(cfg.Pipelines) > 0) != (len(pipelines) > 0) {
+		return errors.New("can't switch between one pipeline and several while running, keeping the current settings")
+	}
+	prev := options
+	if err := apply_config(cfg); err != nil {
+		return err
+	}
+	if len(pipelines) > 0 {
+		return reload_pipelines(cfg)
+	}
+	if err := derive_settings(); err != nil {
+		return err
+	}
+	warn_unapplied("", &prev, &options)
+	if !check_stages(stages) {
+		return errors.New("a stage can't be run")
+	}
+	sup.Reload(options)
+	log.Infof("Reloaded %s, changes take effect at the next restart", config_path)
+	return nil
+}
+
+// reload_pipelines hands the new settings of each pipeline to its
+// supervisor. Pipelines can't be added, removed or renamed while running.
+func reload_pipelines(cfg *Config) error {
+	built, err := build_pipelines(cfg)
+	if err != nil {
+		return err
+	}
+	if len(built) != len(pipelines) {
+		return errors.New("pipelines can't be added or removed while running, keeping the current settings")
+	}
+	for i, p := range pipelines {
+		if built[i].name != p.name {
+			return fmt.Errorf("pipeline %s can't be renamed or moved while running, keeping the current settings", p.name)
+		}
+	}
+	for i, p := range pipelines {
+		warn_unapplied("pipeline "+p.name+": ", &p.options, &built[i].options)
+		p.options = built[i].options
+		p.sup.Reload(p.options)
+	}
+	log.Infof("Reloaded %s, changes take effect at the next restart", config_path)
+	return nil
+}
+
+// warn_unapplied warns about the settings that changed from prev to next
+// but that Reload can't change, and puts the old ones back in next, which
+// the running pipeline keeps using. in prefixes the warnings.
+func warn_unapplied(in string, prev, next *supervisor.Options) {
+	for _, setting := range []struct {
+		name       string
+		prev, next *string
+	}{
+		{"cgroup", &prev.Cgroup, &next.Cgroup},
+		{"transport-addr", &prev.TCPAddr, &next.TCPAddr},
+		{"fifo", &prev.FIFO, &next.FIFO},
+	} {
+		if *setting.prev == *setting.next {
+			continue
+		}
+		still := *setting.prev
+		if still == "" {
+			still = "none"
+		}
+		log.Warningf("%s%s can't be changed while running, still using %s", in, setting.name, still)
+		*setting.next = *setting.prev
+	}
+	if prev.Stdin != next.Stdin || prev.Stdout != next.Stdout {
+		log.Warningf("%sstdin and stdout can't be changed while running, still using the old ones", in)
+		next.Stdin, next.Stdout = prev.Stdin, prev.Stdout
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"time"
+)
+
+// parse_time_of_day parses HH:MM into hours and minutes.
+func parse_time_of_day(s string) (int, int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, 0, fmt.Errorf("expected HH:MM, got %q", s)
+	}
+	return t.Hour(), t.Minute(), nil
+}
+
+// next_time_of_day returns the first hour:minute local time after after.
+func next_time_of_day(after time.Time, hour int, minute int) time.Time {
+	y, m, d := after.Date()
+	next := time.Date(y, m, d, hour, minute, 0, 0, time.Local)
+	if !next.After(after) {
+		next = time.Date(y, m, d+1, hour, minute, 0, 0, time.Local)
+	}
+	return next
+}
+
+// schedule_restarts restarts the pipeline every day at -restart-at, up
+// to -restart-jitter later. The next day's restart is worked out from
+// the time this one was due, not from when it happened, so that a late
+// timer or a restart that ends up right on the time can't make it fire
+// twice. Call it once the supervisor runs.
+func schedule_restarts() {
+	hour, minute, err := parse_time_of_day(restart_at)
+	if err != nil {
+		// Checked in derive_settings.
+		log.Errorf("Bad -restart-at: %v", err)
+		return
+	}
+	go func() {
+		due := next_time_of_day(time.Now(), hour, minute)
+		for {
+			at := due
+			if restart_jitter > 0 {
+				at = at.Add(rand.N(restart_jitter))
+			}
+			log.Debugf("Next scheduled restart at %s", at.Format(time.DateTime))
+			time.Sleep(time.Until(at))
+			log.Warning("Scheduled restart")
+			if err := sup.Restart(); err != nil {
+				log.Warningf("Scheduled restart failed, skipping it: %v", err)
+			}
+			due = next_time_of_day(due, hour, minute)
+		}
+	}()
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parse_size parses a byte count with an optional K, M, G or T suffix
+// (powers of 1024), e.g. "512M".
+func parse_size(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	multiplier := int64(1)
+	if n := len(s); n > 0 {
+		switch strings.ToUpper(s[n-1:]) {
+		case "K":
+			multiplier = 1 << 10
+		case "M":
+			multiplier = 1 << 20
+		case "G":
+			multiplier = 1 << 30
+		case "T":
+			multiplier = 1 << 40
+		}
+		if multiplier > 1 {
+			s = s[:n-1]
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bad size %q", s)
+	}
+	return n * multiplier, nil
+}
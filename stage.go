@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/msoulier/mrun/supervisor"
+)
+
+// StageFlag collects repeated -stage flags.
+type StageFlag []string
+
+func (s *StageFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *StageFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// build_stages works out the pipeline, either from the -stage list or
+// from -producer, -filter and -consumer.
+func build_stages() error {
+	fan_out = false
+	fan_in = false
+	if len(stage_specs) > 0 {
+		if producer != "" || consumer != "" || filter != "" {
+			return fmt.Errorf("use either -stage or -producer and -consumer, not both")
+		}
+		stages = make([]supervisor.Stage, len(stage_specs))
+		for i, spec := range stage_specs {
+			stages[i] = spec
+			stages[i].Role = fmt.Sprintf("stage-%d", i+1)
+			if stages[i].Dir == "" {
+				stages[i].Dir = chdir
+			}
+		}
+		return nil
+	}
+
+	if producer == "" || consumer == "" {
+		return fmt.Errorf("The producer and consumer arguments are required")
+	}
+	stages = []supervisor.Stage{
+		{Role: "producer", Path: producer, Args: producer_args, Dir: producer_chdir},
+		{Role: "consumer", Path: consumer, Args: consumer_args, Dir: consumer_chdir},
+	}
+	// With several consumers the producer's output is copied to each,
+	// with several producers their output is merged.
+	fan_out = len(more_consumers) > 0
+	fan_in = len(more_producers) > 0
+	if fan_out && fan_in {
+		return fmt.Errorf("repeat either -producer or -consumer, not both")
+	}
+	if filter != "" {
+		if fan_out || fan_in {
+			return fmt.Errorf("-filter needs a single producer and consumer")
+		}
+		stages = []supervisor.Stage{
+			stages[0],
+			{Role: "filter", Path: filter, Args: filter_args},
+			stages[1],
+		}
+	}
+	if fan_in {
+		producers := []supervisor.Stage{stages[0]}
+		producers[0].Role = "producer-1"
+		for i, more := range more_producers {
+			more.Role = fmt.Sprintf("producer-%d", i+2)
+			more.Dir = producer_chdir
+			producers = append(producers, more)
+		}
+		stages = append(producers, stages[1])
+	}
+	if fan_out {
+		stages[1].Role = "consumer-1"
+		for i, more := range more_consumers {
+			more.Role = fmt.Sprintf("consumer-%d", i+2)
+			more.Dir = consumer_chdir
+			stages = append(stages, more)
+		}
+	}
+	for i := range stages {
+		if stages[i].Dir == "" {
+			stages[i].Dir = chdir
+		}
+	}
+	return nil
+}
+
+// stage_policies works out the policies of single stages from
+// -producer-policy and -consumer-policy, which cover every producer or
+// consumer.
+func stage_policies() (map[string]supervisor.Policy, error) {
+	policies := make(map[string]supervisor.Policy)
+	for _, side := range []struct{ name, value string }{{"producer", producer_policy}, {"consumer", consumer_policy}} {
+		if side.value == "" {
+			continue
+		}
+		var policy supervisor.Policy
+		switch side.value {
+		case "restart":
+			policy = supervisor.Restart
+		case "norestart":
+			policy = supervisor.NoRestart
+		default:
+			return nil, fmt.Errorf("-%s-policy must be restart or norestart, not %q", side.name, side.value)
+		}
+		if once {
+			return nil, fmt.Errorf("-%s-policy doesn't go with -once", side.name)
+		}
+		found := false
+		for _, stage := range stages {
+			if on_side(stage.Role, side.name) {
+				policies[stage.Role] = policy
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("-%s-policy needs -%s", side.name, side.name)
+		}
+	}
+	return policies, nil
+}
+
+// set_nice applies -producer-nice and -consumer-nice to the stages.
+func set_nice() error {
+	return set_per_side("nice", producer_nice, consumer_nice, -20, 19, func(stage *supervisor.Stage, nice int) {
+		stage.Nice = &nice
+		log.Infof("Running %s at niceness %d", stage.Role, nice)
+	})
+}
+
+// set_oom_score_adj applies -producer-oom-score-adj and
+// -consumer-oom-score-adj to the stages.
+func set_oom_score_adj() error {
+	return set_per_side("oom-score-adj", producer_oom_score_adj, consumer_oom_score_adj, -1000, 1000, func(stage *supervisor.Stage, adj int) {
+		stage.OOMScoreAdj = &adj
+		log.Infof("Running %s with OOM score adjustment %d", stage.Role, adj)
+	})
+}
+
+// set_per_side checks the values of -producer-name and -consumer-name, if
+// given, against the range min to max and sets them on the stages of
+// that side.
+func set_per_side(name string, producer_value, consumer_value, min, max int, set func(*supervisor.Stage, int)) error {
+	for _, side := range []struct {
+		name  string
+		value int
+	}{{"producer", producer_value}, {"consumer", consumer_value}} {
+		flag_name := side.name + "-" + name
+		if !flag_set(flag_name) {
+			continue
+		}
+		if side.value < min || side.value > max {
+			return fmt.Errorf("-%s must be between %d and %d, not %d", flag_name, min, max, side.value)
+		}
+		found := false
+		for i := range stages {
+			if on_side(stages[i].Role, side.name) {
+				set(&stages[i], side.value)
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("-%s needs -%s", flag_name, side.name)
+		}
+	}
+	return nil
+}
+
+// set_health_commands applies -producer-health-cmd and
+// -consumer-health-cmd to the stages.
+func set_health_commands() error {
+	for _, side := range []struct{ name, value string }{{"producer", producer_health_cmd}, {"consumer", consumer_health_cmd}} {
+		flag_name := side.name + "-health-cmd"
+		command, err := command_flag(flag_name, side.value)
+		if err != nil {
+			return err
+		}
+		if command == nil {
+			continue
+		}
+		found := false
+		for i := range stages {
+			if on_side(stages[i].Role, side.name) {
+				stages[i].HealthCommand = command
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("-%s needs -%s", flag_name, side.name)
+		}
+	}
+	return nil
+}
+
+// set_start_delays applies -producer-start-delay and
+// -consumer-start-delay to the stages.
+func set_start_delays() error {
+	for _, side := range []struct {
+		name  string
+		value time.Duration
+	}{{"producer", producer_start_delay}, {"consumer", consumer_start_delay}} {
+		flag_name := side.name + "-start-delay"
+		if !flag_set(flag_name) {
+			continue
+		}
+		if side.value < 0 {
+			return fmt.Errorf("-%s can't be negative", flag_name)
+		}
+		found := false
+		for i := range stages {
+			if on_side(stages[i].Role, side.name) {
+				stages[i].StartDelay = side.value
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("-%s needs -%s", flag_name, side.name)
+		}
+	}
+	return nil
+}
+
+// set_stdin_file gives the producers -stdin-file as their stdin, "-"
+// leaving them ours. A file that can't be read fails the startup.
+func set_stdin_file() error {
+	if stdin_file == "" || stdin_file == "-" {
+		return nil
+	}
+	if bidirectional {
+		return fmt.Errorf("-stdin-file can't be used with -bidirectional, the producer reads the consumer")
+	}
+	f, err := os.Open(stdin_file)
+	if err != nil {
+		return fmt.Errorf("bad -stdin-file: %v", err)
+	}
+	f.Close()
+	path, err := filepath.Abs(stdin_file)
+	if err != nil {
+		return fmt.Errorf("bad -stdin-file: %v", err)
+	}
+	for i := range stages {
+		if on_side(stages[i].Role, "producer") || stages[i].Role == "stage-1" {
+			stages[i].StdinFile = path
+		}
+	}
+	return nil
+}
+
+// on_side reports whether role is the producer or consumer named side,
+// or one of several, e.g. consumer-2.
+func on_side(role string, side string) bool {
+	return role == side || strings.HasPrefix(role, side+"-")
+}
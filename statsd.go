@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Lines waiting to be sent to StatsD before new ones are dropped.
+const statsd_queue_size = 256
+
+// statsd passes the restarts and run durations the supervisor counts on
+// to a StatsD server, as <prefix>.<role>.restarts counters and a
+// <prefix>.run_duration timer.
+type statsd struct {
+	prefix string
+	queue  chan string
+}
+
+// Characters with a meaning in the StatsD protocol, kept out of names.
+var statsd_escape = strings.NewReplacer(":", "_", "|", "_", "@", "_", "\n", "_")
+
+// start_statsd sends the metrics to the StatsD server at addr over UDP.
+func start_statsd(addr string, prefix string) error {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+	s := &statsd{prefix: strings.TrimSuffix(prefix, "."), queue: make(chan string, statsd_queue_size)}
+	go func() {
+		for line := range s.queue {
+			// Nobody may be listening, that's fine.
+			if _, err := conn.Write([]byte(line)); err != nil {
+				log.Debugf("Cannot send %q to StatsD: %v", line, err)
+			}
+		}
+	}()
+	sup.Metrics().Listen(s)
+	log.Infof("Sending metrics to StatsD at %s", conn.RemoteAddr())
+	return nil
+}
+
+// name returns the name of a metric under the prefix.
+func (s *statsd) name(parts ...string) string {
+	if s.prefix != "" {
+		parts = append([]string{s.prefix}, parts...)
+	}
+	return statsd_escape.Replace(strings.Join(parts, "."))
+}
+
+// send queues line, or drops it if the sender is that far behind.
+func (s *statsd) send(line string) {
+	select {
+	case s.queue <- line:
+	default:
+	}
+}
+
+func (s *statsd) Restarted(role string) {
+	s.send(fmt.Sprintf("%s:1|c", s.name(role, "restarts")))
+}
+
+func (s *statsd) ObservedRun(d time.Duration) {
+	s.send(fmt.Sprintf("%s:%d|ms", s.name("run_duration"), d.Milliseconds()))
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/msoulier/mrun/supervisor"
+)
+
+// When mrun started, for the uptime of the summary.
+var start_time = time.Now()
+
+var (
+	stop_reason_mu sync.Mutex
+	// Why mrun was told to stop, the first time it was: signal,
+	// stop_requested or max_runtime.
+	stop_reason string
+)
+
+// stopping_because records why mrun is stopping, unless it already is.
+func stopping_because(reason string) {
+	stop_reason_mu.Lock()
+	defer stop_reason_mu.Unlock()
+	if stop_reason == "" {
+		stop_reason = reason
+	}
+}
+
+// run_result is how the run of a pipeline ended.
+type run_result struct {
+	err  error
+	code int
+}
+
+// exit_summary is the last line mrun logs, for whoever has to work out
+// afterwards what happened, e.g. in a CI log.
+type exit_summary struct {
+	// Why the pipeline stopped: signal, stop_requested, max_runtime,
+	// max_restarts, rate_limited, stage_exit, once_complete, finished or
+	// error.
+	Reason        string  `json:"reason"`
+	ExitCode      int     `json:"exit_code"`
+	UptimeSeconds float64 `json:"uptime_seconds,omitempty"`
+	// The restarts that happened, not counting the exit that ended the
+	// run.
+	Restarts map[string]uint64 `json:"restarts,omitempty"`
+	// The last exit status of each stage, -1 if it was killed.
+	LastExitStatus map[string]int `json:"last_exit_status,omitempty"`
+	Error          string         `json:"error,omitempty"`
+	// With several pipelines, the summary of each.
+	Pipelines map[string]*exit_summary `json:"pipelines,omitempty"`
+}
+
+// exit_reason says why a pipeline run under policy ended with err.
+func exit_reason(err error, policy supervisor.Policy) string {
+	var exit *supervisor.ExitError
+	switch {
+	case errors.Is(err, supervisor.ErrMaxRestarts):
+		return "max_restarts"
+	case errors.Is(err, supervisor.ErrRateLimited):
+		return "rate_limited"
+	case errors.As(err, &exit):
+		return "stage_exit"
+	case err != nil:
+		return "error"
+	}
+	stop_reason_mu.Lock()
+	defer stop_reason_mu.Unlock()
+	switch {
+	case stop_reason != "":
+		return stop_reason
+	case policy == supervisor.Once:
+		return "once_complete"
+	}
+	return "finished"
+}
+
+// pipeline_summary sums up the run of the pipeline s ran under policy.
+func pipeline_summary(s *supervisor.Supervisor, policy supervisor.Policy, result run_result) *exit_summary {
+	summary := &exit_summary{
+		Reason:   exit_reason(result.err, policy),
+		ExitCode: result.code,
+	}
+	summary.Restarts, summary.LastExitStatus = s.Metrics().Totals()
+	if result.err != nil {
+		summary.Error = result.err.Error()
+	}
+	return summary
+}
+
+// log_summary logs how the run ended as a single line of JSON, or as the
+// fields of the log entry with -logjson.
+func log_summary(results []run_result, code int) {
+	var summary *exit_summary
+	if len(pipelines) == 0 {
+		summary = pipeline_summary(sup, options.Policy, results[0])
+	} else {
+		summary = &exit_summary{Pipelines: make(map[string]*exit_summary)}
+		for i, p := range pipelines {
+			summary.Pipelines[p.name] = pipeline_summary(p.sup, p.options.Policy, results[i])
+		}
+		summary.Reason = exit_reason(nil, supervisor.Restart)
+		for _, p := range pipelines {
+			if ps := summary.Pipelines[p.name]; ps.ExitCode != 0 {
+				summary.Reason = ps.Reason
+				break
+			}
+		}
+	}
+	summary.ExitCode = code
+	summary.UptimeSeconds = time.Since(start_time).Seconds()
+	if log_json {
+		log.Info(supervisor.WithFields("Summary", supervisor.Fields{"summary": summary}))
+		return
+	}
+	data, err := json.Marshal(summary)
+	if err != nil {
+		log.Errorf("Cannot sum up the run: %v", err)
+		return
+	}
+	log.Infof("Summary %s", data)
+}
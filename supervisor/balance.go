@@ -0,0 +1,298 @@
+package supervisor
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"hash/fnv"
+	"io"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// BalanceFull says what a Balancer does with a line for a consumer whose
+// buffer is full.
+type BalanceFull int
+
+const (
+	// Give the line to the next consumer that has room, or wait for the
+	// first one that has if none has.
+	BalanceSkip BalanceFull = iota
+	// Drop the line.
+	BalanceDrop
+	// Wait for the consumer, holding the producer and so the others back.
+	BalanceBlock
+)
+
+// Balancer hands each line the producer writes to one consumer, in
+// turn, or by its key with Options.PartitionBy, for Options.Balance.
+// Each consumer has a buffer of Options.BalanceBuffer lines, written to
+// it by a goroutine of its own, so a slow one only holds the others up
+// once its buffer is full, and then only with BalanceBlock. The buffer
+// of a consumer that is down waits for it to be attached again; the
+// line it was being written is written again, whole, to the new one.
+type Balancer struct {
+	sup     *Supervisor
+	mu      sync.Mutex
+	outputs []*balance_output
+	// Signalled when a consumer is attached, or the pipeline is being
+	// stopped.
+	attached *sync.Cond
+	// The consumer to give the next line to.
+	next int
+	// Set once the pipeline is being stopped, nothing will drain the
+	// buffers any more.
+	stopping bool
+	stop     chan struct{}
+	wg       sync.WaitGroup
+	done     chan struct{}
+}
+
+type balance_output struct {
+	role  string
+	lines chan []byte
+	// nil while the consumer is down.
+	file *os.File
+	// Set once the buffer is empty after the producer's output has
+	// ended.
+	finished bool
+	// When the buffer being full was last logged, at most once a minute.
+	warned time.Time
+	// Lines dropped with BalanceDrop.
+	dropped uint64
+}
+
+// new_balancer makes a Balancer for the consumers roles, in the order
+// they get lines.
+func new_balancer(sup *Supervisor, roles []string) *Balancer {
+	size := max(sup.opts.BalanceBuffer, 1)
+	b := &Balancer{sup: sup, stop: make(chan struct{}), done: make(chan struct{})}
+	b.attached = sync.NewCond(&b.mu)
+	for _, role := range roles {
+		o := &balance_output{role: role, lines: make(chan []byte, size)}
+		b.outputs = append(b.outputs, o)
+		b.wg.Add(1)
+		go b.output(o)
+	}
+	return b
+}
+
+// Attach makes w the stdin of role, replacing any previous one.
+func (b *Balancer) Attach(role string, w *os.File) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, o := range b.outputs {
+		if o.role != role {
+			continue
+		}
+		if o.file != nil {
+			o.file.Close()
+			o.file = nil
+		}
+		if o.finished {
+			// Nothing more is coming, the consumer gets EOF.
+			w.Close()
+			return
+		}
+		o.file = w
+		b.attached.Broadcast()
+		return
+	}
+	w.Close()
+}
+
+// output writes the buffer of o to its consumer until the producer's
+// output has ended, then closes its stdin.
+func (b *Balancer) output(o *balance_output) {
+	defer b.wg.Done()
+	for line := range o.lines {
+		if !b.write(o, line) {
+			return
+		}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	o.finished = true
+	if o.file != nil {
+		o.file.Close()
+		o.file = nil
+	}
+}
+
+// write writes line to the consumer of o, waiting for it while it is
+// down. It returns false if the pipeline is stopped first.
+func (b *Balancer) write(o *balance_output, line []byte) bool {
+	for {
+		b.mu.Lock()
+		for o.file == nil && !b.stopping {
+			b.attached.Wait()
+		}
+		f := o.file
+		b.mu.Unlock()
+		if f == nil {
+			return false
+		}
+		_, err := f.Write(line)
+		if err == nil {
+			return true
+		}
+		log.Debugf("%s stopped reading: %v", o.role, err)
+		b.mu.Lock()
+		if o.file == f {
+			o.file = nil
+			f.Close()
+		}
+		b.mu.Unlock()
+	}
+}
+
+// Run hands out the lines of src until it hits EOF, then closes the
+// buffers. A last line without a newline is handed out as it is.
+func (b *Balancer) Run(src *os.File) {
+	defer close(b.done)
+	defer src.Close()
+	defer func() {
+		for _, o := range b.outputs {
+			close(o.lines)
+		}
+	}()
+	r := bufio.NewReaderSize(src, max(b.sup.opts.PumpBuffer, 4096))
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 && !b.dispatch(line) {
+			return
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Errorf("Reading from the producer failed: %v", err)
+			}
+			return
+		}
+	}
+}
+
+// dispatch gives line to the next consumer, under
+// Options.BalanceWhenFull if its buffer is full. It returns false if the
+// pipeline is stopped meanwhile.
+func (b *Balancer) dispatch(line []byte) bool {
+	var o *balance_output
+	if b.sup.opts.PartitionBy > 0 {
+		o = b.outputs[b.partition(line)]
+	} else {
+		o = b.outputs[b.next]
+		b.next = (b.next + 1) % len(b.outputs)
+	}
+	select {
+	case o.lines <- line:
+		return true
+	default:
+	}
+	when_full := b.sup.opts.BalanceWhenFull
+	if when_full == BalanceSkip && b.sup.opts.PartitionBy > 0 {
+		// The line can't go anywhere else.
+		when_full = BalanceBlock
+	}
+	switch when_full {
+	case BalanceDrop:
+		o.dropped++
+		b.filled(o)
+		return true
+	case BalanceBlock:
+		b.filled(o)
+		select {
+		case o.lines <- line:
+			return true
+		case <-b.stop:
+			return false
+		}
+	}
+	// The next one in turn with room, or whichever has room first.
+	b.filled(o)
+	for range b.outputs[1:] {
+		o := b.outputs[b.next]
+		b.next = (b.next + 1) % len(b.outputs)
+		select {
+		case o.lines <- line:
+			return true
+		default:
+		}
+		b.filled(o)
+	}
+	cases := []reflect.SelectCase{{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(b.stop)}}
+	for _, o := range b.outputs {
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectSend, Chan: reflect.ValueOf(o.lines), Send: reflect.ValueOf(line)})
+	}
+	chosen, _, _ := reflect.Select(cases)
+	return chosen > 0
+}
+
+// partition returns the consumer for line under Options.PartitionBy: a
+// hash of the field picks it, the first one if there is no such field.
+func (b *Balancer) partition(line []byte) int {
+	line = bytes.TrimRight(line, "\r\n")
+	for range b.sup.opts.PartitionBy - 1 {
+		i := bytes.IndexByte(line, b.sup.opts.PartitionDelimiter)
+		if i < 0 {
+			return 0
+		}
+		line = line[i+1:]
+	}
+	if i := bytes.IndexByte(line, b.sup.opts.PartitionDelimiter); i >= 0 {
+		line = line[:i]
+	}
+	h := fnv.New32a()
+	h.Write(line)
+	return int(h.Sum32() % uint32(len(b.outputs)))
+}
+
+// filled logs that the buffer of o is full, at most once a minute.
+func (b *Balancer) filled(o *balance_output) {
+	if time.Since(o.warned) < time.Minute {
+		return
+	}
+	o.warned = time.Now()
+	switch b.sup.opts.BalanceWhenFull {
+	case BalanceDrop:
+		log.Warningf("The buffer of %s is full, dropping its lines, %d so far", o.role, o.dropped)
+	case BalanceBlock:
+		log.Warningf("The buffer of %s is full, holding the producer back", o.role)
+	default:
+		if b.sup.opts.PartitionBy > 0 {
+			log.Warningf("The buffer of %s is full, holding the producer back", o.role)
+			return
+		}
+		log.Warningf("The buffer of %s is full, giving its lines to the others", o.role)
+	}
+}
+
+// Respawn starts a consumer again on a new pipe, see
+// start_balanced_consumer.
+func (b *Balancer) Respawn(ctx context.Context, stage Stage, comms chan ChildEvent) (int, error) {
+	pipes, err := b.sup.make_data_pipes(1)
+	if err != nil {
+		return -1, err
+	}
+	return b.sup.start_balanced_consumer(ctx, stage, b, pipes[0], comms), nil
+}
+
+// Wait blocks until Run and the writes to the consumers have finished,
+// dropping what is left in the buffers.
+func (b *Balancer) Wait() {
+	b.mu.Lock()
+	b.stopping = true
+	b.attached.Broadcast()
+	b.mu.Unlock()
+	close(b.stop)
+	<-b.done
+	b.wg.Wait()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, o := range b.outputs {
+		if o.file != nil {
+			o.file.Close()
+			o.file = nil
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package supervisor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Bridge carries the output of the producer to the consumer over TCP,
+// for Options.TCPAddr. It listens for as long as Run runs, and sends
+// what the producer writes to the pipe it reads to every connection, the
+// one the consumer reads from and any made from elsewhere, e.g. to look
+// at the stream. A reader that doesn't keep up holds up the others, as
+// one pipe would. When the producer's output ends every connection is
+// closed, so they all see EOF. With Options.Compress the stream to each
+// connection is gzipped, and the consumer's is decompressed again before
+// it gets it.
+type Bridge struct {
+	sup      *Supervisor
+	listener net.Listener
+
+	mu    sync.Mutex
+	conns map[net.Conn]*bridge_output
+	// Signalled as each connection is added.
+	added *sync.Cond
+	// The copy of the current run.
+	done chan struct{}
+	// The decompression for the consumer of the current run.
+	gunzips sync.WaitGroup
+}
+
+// open_bridge listens on Options.TCPAddr and accepts connections until
+// close.
+func (s *Supervisor) open_bridge() (*Bridge, error) {
+	l, err := net.Listen("tcp", s.opts.TCPAddr)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Passing the producer's output on over TCP on %s", l.Addr())
+	b := &Bridge{sup: s, listener: l, conns: make(map[net.Conn]*bridge_output)}
+	b.added = sync.NewCond(&b.mu)
+	go b.accept()
+	return b, nil
+}
+
+func (b *Bridge) accept() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		log.Debugf("%s connected to the bridge", conn.RemoteAddr())
+		// Only the producer's output goes this way.
+		conn.(*net.TCPConn).CloseRead()
+		b.mu.Lock()
+		b.conns[conn] = b.new_output(conn)
+		b.added.Broadcast()
+		b.mu.Unlock()
+	}
+}
+
+// close stops listening and closes every connection.
+func (b *Bridge) close() {
+	b.listener.Close()
+	b.drop_all()
+}
+
+func (b *Bridge) drop(conn net.Conn) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.conns, conn)
+	conn.Close()
+}
+
+// outputs returns the streams to the connections.
+func (b *Bridge) outputs() []*bridge_output {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	outputs := make([]*bridge_output, 0, len(b.conns))
+	for _, o := range b.conns {
+		outputs = append(outputs, o)
+	}
+	return outputs
+}
+
+// end_all ends the stream to every connection, then closes them.
+func (b *Bridge) end_all() {
+	// Not under mu, so that drop_all can still cut a reader that holds
+	// the end up.
+	for _, o := range b.outputs() {
+		o.finish()
+	}
+	b.drop_all()
+}
+
+func (b *Bridge) drop_all() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for conn := range b.conns {
+		conn.Close()
+	}
+	clear(b.conns)
+}
+
+// start_bridged starts a producer and a consumer connected through b.
+// The consumer's stdin is a connection to b, made here. It returns the
+// child ends like start_pipeline.
+func (s *Supervisor) start_bridged(ctx context.Context, pipeline []Stage, comms chan ChildEvent) ([]int, Hub, error) {
+	b := s.bridge
+	pipes, err := s.make_data_pipes(1)
+	if err != nil {
+		return nil, nil, err
+	}
+	var infd int
+	if s.opts.Compress != "" {
+		infd, err = b.dial_gunzip(pipeline[0].Role)
+	} else {
+		infd, err = b.dial()
+	}
+	if err != nil {
+		syscall.Close(pipes[0][0])
+		syscall.Close(pipes[0][1])
+		return nil, nil, fmt.Errorf("cannot connect the %s to the bridge: %v", pipeline[1].Role, err)
+	}
+	b.done = make(chan struct{})
+	go b.copy(pipeline[0].Role, os.NewFile(uintptr(pipes[0][0]), pipeline[0].Role+" stdout"))
+	go s.start_producer(ctx, pipeline[0], pipeline[1], -1, pipes[0][1], comms)
+	go s.watch_stage(ctx, pipeline[1], infd, -1, comms)
+	return []int{pipes[0][1], infd}, b, nil
+}
+
+// dial connects to b and returns the fd of the connection, in blocking
+// mode for the child. It only returns once b has accepted it, so that
+// the child gets the producer's output from the start.
+func (b *Bridge) dial() (int, error) {
+	conn, err := net.Dial("tcp", b.listener.Addr().String())
+	if err != nil {
+		return -1, err
+	}
+	defer conn.Close()
+	b.wait_accepted(conn.LocalAddr().String())
+	f, err := conn.(*net.TCPConn).File()
+	if err != nil {
+		return -1, err
+	}
+	defer f.Close()
+	// Fd puts the file in blocking mode, and the copy outlives f.
+	fd, err := unix.FcntlInt(f.Fd(), unix.F_DUPFD_CLOEXEC, 0)
+	if err != nil {
+		return -1, err
+	}
+	return fd, nil
+}
+
+// wait_accepted waits until the connection from addr has been accepted.
+func (b *Bridge) wait_accepted(addr string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for {
+		for conn := range b.conns {
+			if conn.RemoteAddr().String() == addr {
+				return
+			}
+		}
+		b.added.Wait()
+	}
+}
+
+// copy sends what role writes to src on to every connection, until src
+// hits EOF.
+func (b *Bridge) copy(role string, src *os.File) {
+	defer close(b.done)
+	defer src.Close()
+	defer b.end_all()
+	if b.sup.opts.Compress != "" {
+		stop := make(chan struct{})
+		defer close(stop)
+		go b.flush_every(stop)
+	}
+	size := b.sup.opts.PumpBuffer
+	if size <= 0 {
+		size = 32 * 1024
+	}
+	buf := make([]byte, size)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			for _, o := range b.outputs() {
+				if err := o.write(buf[:n]); err != nil {
+					log.Debugf("%s stopped reading: %v", o.conn.RemoteAddr(), err)
+					b.drop(o.conn)
+				}
+			}
+			b.sup.metrics.Pumped(role, n, bytes.Count(buf[:n], []byte{'\n'}))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Respawn fails, the stages of a bridged pipeline restart together.
+func (b *Bridge) Respawn(ctx context.Context, stage Stage, comms chan ChildEvent) (int, error) {
+	return -1, fmt.Errorf("%s can't be restarted on its own", stage.Role)
+}
+
+// Wait blocks until the producer's output has all been sent on, and
+// decompressed for the consumer with Options.Compress, or for
+// Options.StopTimeout if a reader holds it up, which is then dropped.
+func (b *Bridge) Wait() {
+	defer b.gunzips.Wait()
+	select {
+	case <-b.done:
+		return
+	case <-time.After(b.sup.opts.StopTimeout):
+	}
+	log.Warning("A reader of the bridge isn't keeping up, dropping the connections")
+	b.drop_all()
+	<-b.done
+}
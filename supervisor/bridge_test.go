@@ -0,0 +1,44 @@
+package supervisor_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/msoulier/mrun/supervisor"
+)
+
+func TestCompressedBridge(t *testing.T) {
+	var out bytes.Buffer
+	s, err := supervisor.New(supervisor.Options{
+		Stages: []supervisor.Stage{
+			{Role: "producer", Path: look_path(t, "seq"), Args: []string{"10000"}},
+			{Role: "consumer", Path: look_path(t, "cat")},
+		},
+		TCPAddr:     "127.0.0.1:0",
+		Compress:    "gzip",
+		Policy:      supervisor.Once,
+		Stdout:      &out,
+		StopTimeout: time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.Run(ctx); err != nil {
+		t.Fatalf("Run returned %v", err)
+	}
+	if ctx.Err() != nil {
+		t.Fatal("the consumer didn't see EOF")
+	}
+	var want bytes.Buffer
+	for i := 1; i <= 10000; i++ {
+		fmt.Fprintln(&want, i)
+	}
+	if !bytes.Equal(out.Bytes(), want.Bytes()) {
+		t.Errorf("the consumer got %d bytes, not the %d of the producer", out.Len(), want.Len())
+	}
+}
@@ -0,0 +1,145 @@
+package supervisor
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// The period of cpu.max, in microseconds, as the kernel defaults to.
+const cpu_max_period = 100000
+
+// cgroup is the cgroup v2 the children are moved into, see
+// Options.Cgroup.
+type cgroup struct {
+	path string
+	// The directories we created, outermost first, to remove again.
+	created []string
+}
+
+// cgroup2_mount returns where the cgroup v2 hierarchy is mounted, which
+// is /sys/fs/cgroup/unified on hybrid systems.
+func cgroup2_mount() (string, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// ID parent major:minor root mountpoint options... - fstype ...
+		fields := strings.Fields(scanner.Text())
+		i := slices.Index(fields, "-")
+		if i > 4 && i+1 < len(fields) && fields[i+1] == "cgroup2" {
+			return fields[4], nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", errors.New("no cgroup2 file system is mounted")
+}
+
+// setup_cgroup creates Options.Cgroup if need be and sets its limits.
+// It returns nil, after a warning, if the children can't be put in it,
+// and warns about limits that can't be set but uses it anyway.
+func (s *Supervisor) setup_cgroup() *cgroup {
+	opts := s.opts
+	root, err := cgroup2_mount()
+	if err != nil {
+		log.Warningf("cgroup v2 is not available, not using cgroup %s: %v", opts.Cgroup, err)
+		return nil
+	}
+	cg := &cgroup{path: filepath.Join(root, opts.Cgroup)}
+	var controllers []string
+	if opts.CgroupMemoryMax > 0 {
+		controllers = append(controllers, "memory")
+	}
+	if opts.CgroupCPUMax > 0 {
+		controllers = append(controllers, "cpu")
+	}
+	dir := root
+	for _, name := range strings.Split(filepath.Clean(opts.Cgroup), "/") {
+		// Each level needs the controllers enabled for the one below.
+		if err := enable_controllers(dir, controllers); err != nil {
+			log.Warningf("Cannot enable the %s controllers in %s: %v", strings.Join(controllers, " and "), dir, err)
+			controllers = nil
+		}
+		dir = filepath.Join(dir, name)
+		err := os.Mkdir(dir, 0755)
+		if err == nil {
+			log.Debugf("Created cgroup %s", dir)
+			cg.created = append(cg.created, dir)
+			continue
+		}
+		if !errors.Is(err, os.ErrExist) {
+			log.Warningf("Cannot create cgroup %s, not using it: %v", dir, err)
+			cg.remove()
+			return nil
+		}
+	}
+	if opts.CgroupMemoryMax > 0 {
+		cg.set("memory.max", strconv.FormatUint(opts.CgroupMemoryMax, 10))
+	}
+	if opts.CgroupCPUMax > 0 {
+		quota := int64(opts.CgroupCPUMax * cpu_max_period)
+		cg.set("cpu.max", fmt.Sprintf("%d %d", max(quota, 1000), cpu_max_period))
+	}
+	log.Infof("Running the children in cgroup %s", cg.path)
+	return cg
+}
+
+// enable_controllers enables those of controllers that aren't yet for
+// the children of the cgroup dir.
+func enable_controllers(dir string, controllers []string) error {
+	if len(controllers) == 0 {
+		return nil
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "cgroup.subtree_control"))
+	if err != nil {
+		return err
+	}
+	enabled := strings.Fields(string(data))
+	var changes []string
+	for _, controller := range controllers {
+		if !slices.Contains(enabled, controller) {
+			changes = append(changes, "+"+controller)
+		}
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	return os.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte(strings.Join(changes, " ")), 0)
+}
+
+// set writes value to the control file name of the cgroup, warning if
+// that fails.
+func (cg *cgroup) set(name string, value string) {
+	if err := os.WriteFile(filepath.Join(cg.path, name), []byte(value), 0); err != nil {
+		log.Warningf("Cannot set %s of cgroup %s to %s: %v", name, cg.path, value, err)
+		return
+	}
+	log.Debugf("Set %s of cgroup %s to %s", name, cg.path, value)
+}
+
+// add moves the process pid into the cgroup.
+func (cg *cgroup) add(pid uintptr) error {
+	return os.WriteFile(filepath.Join(cg.path, "cgroup.procs"), []byte(strconv.FormatUint(uint64(pid), 10)), 0)
+}
+
+// remove removes the directories setup_cgroup created, which only works
+// once nothing runs in them any longer.
+func (cg *cgroup) remove() {
+	for i := len(cg.created) - 1; i >= 0; i-- {
+		if err := os.Remove(cg.created[i]); err != nil {
+			log.Warningf("Cannot remove cgroup %s: %v", cg.created[i], err)
+			return
+		}
+		log.Debugf("Removed cgroup %s", cg.created[i])
+	}
+}
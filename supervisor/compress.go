@@ -0,0 +1,138 @@
+package supervisor
+
+import (
+	"compress/gzip"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// How long compressed data may wait in a bridge_output before it is
+// flushed. Flushing after every write would add a gzip block, and bytes,
+// to each one.
+const compress_flush = 100 * time.Millisecond
+
+// bridge_output is the stream of a Bridge to one connection, gzipped
+// with Options.Compress.
+type bridge_output struct {
+	conn net.Conn
+	mu   sync.Mutex
+	// nil without compression.
+	zw *gzip.Writer
+	// Whether zw holds data that hasn't been flushed yet.
+	pending bool
+}
+
+func (b *Bridge) new_output(conn net.Conn) *bridge_output {
+	o := &bridge_output{conn: conn}
+	if b.sup.opts.Compress == "gzip" {
+		o.zw = gzip.NewWriter(conn)
+	}
+	return o
+}
+
+func (o *bridge_output) write(data []byte) error {
+	if o.zw == nil {
+		_, err := o.conn.Write(data)
+		return err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.pending = true
+	_, err := o.zw.Write(data)
+	return err
+}
+
+func (o *bridge_output) flush() error {
+	if o.zw == nil {
+		return nil
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !o.pending {
+		return nil
+	}
+	o.pending = false
+	return o.zw.Flush()
+}
+
+// finish ends the compressed stream, the connection stays open.
+func (o *bridge_output) finish() {
+	if o.zw == nil {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.zw.Close()
+}
+
+// flush_every flushes the outputs of b every compress_flush until stop
+// is closed.
+func (b *Bridge) flush_every(stop chan struct{}) {
+	ticker := time.NewTicker(compress_flush)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		for _, o := range b.outputs() {
+			if err := o.flush(); err != nil {
+				log.Debugf("%s stopped reading: %v", o.conn.RemoteAddr(), err)
+				b.drop(o.conn)
+			}
+		}
+	}
+}
+
+// dial_gunzip connects to b like dial, and returns the read end of a pipe
+// that the compressed stream of the connection is decompressed into. The
+// compressed bytes are counted in Metrics.Compressed, against role, the
+// producer.
+func (b *Bridge) dial_gunzip(role string) (int, error) {
+	conn, err := net.Dial("tcp", b.listener.Addr().String())
+	if err != nil {
+		return -1, err
+	}
+	b.wait_accepted(conn.LocalAddr().String())
+	pipes, err := b.sup.make_data_pipes(1)
+	if err != nil {
+		conn.Close()
+		return -1, err
+	}
+	b.gunzips.Add(1)
+	go b.gunzip(role, conn, os.NewFile(uintptr(pipes[0][1]), "bridge gunzip"))
+	return pipes[0][0], nil
+}
+
+// gunzip decompresses what comes in on conn into w until either ends.
+func (b *Bridge) gunzip(role string, conn net.Conn, w *os.File) {
+	defer b.gunzips.Done()
+	defer conn.Close()
+	defer w.Close()
+	zr, err := gzip.NewReader(counted_reader{conn, func(n int) { b.sup.metrics.Compressed(role, n) }})
+	if err != nil {
+		if err != io.EOF {
+			log.Errorf("Cannot decompress the bridge: %v", err)
+		}
+		return
+	}
+	if _, err := io.Copy(w, zr); err != nil {
+		log.Debugf("Decompressing the bridge stopped: %v", err)
+	}
+}
+
+// counted_reader calls count with the size of every read from r.
+type counted_reader struct {
+	r     io.Reader
+	count func(int)
+}
+
+func (c counted_reader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.count(n)
+	return n, err
+}
@@ -0,0 +1,91 @@
+package supervisor
+
+import (
+	"fmt"
+	"time"
+)
+
+// control_request is a command for the supervision loop. The loop
+// answers on reply, which must be buffered so it never blocks on a
+// caller that has given up.
+type control_request struct {
+	// One of status, restart or restart_stage.
+	command string
+	// For restart_stage, the stage.
+	role  string
+	reply chan control_reply
+}
+
+type control_reply struct {
+	status *Status
+	err    error
+}
+
+// Status is a snapshot of the supervision state.
+type Status struct {
+	Pids           map[string]uintptr `json:"pids"`
+	Restarts       map[string]uint64  `json:"restarts"`
+	LastExitStatus map[string]int     `json:"last_exit_status"`
+	UptimeSeconds  float64            `json:"uptime_seconds"`
+	// For each running stage, when its child was started and how long
+	// it has been up.
+	StartedAt          map[string]time.Time `json:"started_at"`
+	StageUptimeSeconds map[string]float64   `json:"stage_uptime_seconds"`
+	// When each stage that has exited last did so, LastExitStatus says
+	// how.
+	LastExitTime map[string]time.Time `json:"last_exit_time"`
+	// What went through the pump, by the role of the sending stage.
+	Pumped map[string]PumpCounts `json:"pumped,omitempty"`
+}
+
+// PumpCounts is what a Pump has copied from one stage to the next.
+type PumpCounts struct {
+	Bytes uint64 `json:"bytes"`
+	Lines uint64 `json:"lines"`
+}
+
+// send_control passes command, for the stage role if it is about one, to
+// the supervision loop and waits for its answer. The loop only listens
+// while the pipeline is up, so give up rather than hang while it is
+// restarting.
+func (s *Supervisor) send_control(command string, role string) (control_reply, error) {
+	req := control_request{command: command, role: role, reply: make(chan control_reply, 1)}
+	timeout := time.After(5 * time.Second)
+	select {
+	case s.control <- req:
+	case <-timeout:
+		return control_reply{}, fmt.Errorf("supervisor busy, try again")
+	}
+	select {
+	case reply := <-req.reply:
+		return reply, reply.err
+	case <-timeout:
+		return control_reply{}, fmt.Errorf("supervisor busy, try again")
+	}
+}
+
+// Status returns a snapshot of the running pipeline.
+func (s *Supervisor) Status() (*Status, error) {
+	reply, err := s.send_control("status", "")
+	if err != nil {
+		return nil, err
+	}
+	return reply.status, nil
+}
+
+// Restart stops the pipeline and starts it again straight away. This
+// does not count as a failure. Under Options.ZeroDowntime it replaces
+// the last stage instead, and returns once the replacement has been
+// started.
+func (s *Supervisor) Restart() error {
+	_, err := s.send_control("restart", "")
+	return err
+}
+
+// RestartStage stops the child of role and starts it again straight
+// away, without counting a failure, when Options.IndependentRestart
+// lets it restart on its own. Otherwise it does what Restart does.
+func (s *Supervisor) RestartStage(role string) error {
+	_, err := s.send_control("restart_stage", role)
+	return err
+}
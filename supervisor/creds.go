@@ -0,0 +1,90 @@
+package supervisor
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// Credentials the children are switched to before exec.
+type Credentials struct {
+	Uid    int
+	Gid    int
+	Groups []uint32
+}
+
+// ResolveCredentials looks up a user and a group, either of which may be
+// a name, a numeric id or empty. The group defaults to the user's
+// primary group, and the supplementary groups are the user's groups.
+func ResolveCredentials(username, groupname string) (*Credentials, error) {
+	if username == "" && groupname == "" {
+		return nil, nil
+	}
+	creds := &Credentials{Uid: -1, Gid: -1}
+
+	if username != "" {
+		u, err := user.Lookup(username)
+		if err != nil {
+			u, err = user.LookupId(username)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unknown user %q", username)
+		}
+		if creds.Uid, err = strconv.Atoi(u.Uid); err != nil {
+			return nil, fmt.Errorf("bad uid %q for user %s", u.Uid, username)
+		}
+		if creds.Gid, err = strconv.Atoi(u.Gid); err != nil {
+			return nil, fmt.Errorf("bad gid %q for user %s", u.Gid, username)
+		}
+		gids, err := u.GroupIds()
+		if err != nil {
+			return nil, fmt.Errorf("cannot list groups of %s: %v", username, err)
+		}
+		for _, g := range gids {
+			gid, err := strconv.Atoi(g)
+			if err != nil {
+				continue
+			}
+			creds.Groups = append(creds.Groups, uint32(gid))
+		}
+	}
+
+	if groupname != "" {
+		g, err := user.LookupGroup(groupname)
+		if err != nil {
+			g, err = user.LookupGroupId(groupname)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unknown group %q", groupname)
+		}
+		if creds.Gid, err = strconv.Atoi(g.Gid); err != nil {
+			return nil, fmt.Errorf("bad gid %q for group %s", g.Gid, groupname)
+		}
+		if username == "" {
+			creds.Groups = []uint32{uint32(creds.Gid)}
+		}
+	}
+	return creds, nil
+}
+
+// credential converts creds for syscall.SysProcAttr, nil to keep ours.
+// An id of -1 keeps our own.
+func (creds *Credentials) credential() *syscall.Credential {
+	if creds == nil {
+		return nil
+	}
+	cred := &syscall.Credential{
+		Uid:    uint32(os.Getuid()),
+		Gid:    uint32(os.Getgid()),
+		Groups: creds.Groups,
+	}
+	if creds.Uid >= 0 {
+		cred.Uid = uint32(creds.Uid)
+	}
+	if creds.Gid >= 0 {
+		cred.Gid = uint32(creds.Gid)
+	}
+	return cred
+}
@@ -0,0 +1,58 @@
+package supervisor
+
+import (
+	"syscall"
+	"time"
+)
+
+// drain shuts the pipeline down in order for Options.DrainTimeout: the
+// first stage is stopped, the way terminate does, and the others then
+// read to the EOF that follows and exit on their own, for at most
+// DrainTimeout after it has gone. What is still running then is left to
+// stop_children. The maps are those of stop_children, and are updated
+// with the exits and starts seen meanwhile.
+func (s *Supervisor) drain(first string, comms chan ChildEvent, running map[string]uintptr, respawning map[string]int, others map[uintptr]string) {
+	pid, ok := running[first]
+	if !ok || len(running) < 2 {
+		return
+	}
+	log.Infof("Draining: stopping %s (PID %d), waiting up to %v for the others to finish", first, pid, s.opts.DrainTimeout)
+	s.kill(pid, s.opts.StopSignal)
+	kill := time.NewTimer(s.opts.StopTimeout)
+	defer kill.Stop()
+	// Set once the first stage has gone.
+	var deadline <-chan time.Time
+	for len(running) > 0 {
+		select {
+		case ev := <-comms:
+			if !ev.Exited {
+				syscall.Close(respawning[ev.Role])
+				delete(respawning, ev.Role)
+				if ev.Err == nil {
+					running[ev.Role] = ev.Pid
+				}
+				continue
+			}
+			if _, ok := others[ev.Pid]; ok {
+				delete(others, ev.Pid)
+				continue
+			}
+			if running[ev.Role] == ev.Pid {
+				delete(running, ev.Role)
+			}
+			if ev.Role == first {
+				kill.Stop()
+				timer := time.NewTimer(s.opts.DrainTimeout)
+				defer timer.Stop()
+				deadline = timer.C
+			}
+		case <-kill.C:
+			log.Warningf("%s (PID %d) did not stop within %v, sending SIGKILL", first, pid, s.opts.StopTimeout)
+			s.kill(pid, syscall.SIGKILL)
+		case <-deadline:
+			log.Warningf("The pipeline did not drain within %v, stopping the rest", s.opts.DrainTimeout)
+			return
+		}
+	}
+	log.Info("Drained the pipeline")
+}
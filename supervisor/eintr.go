@@ -0,0 +1,15 @@
+package supervisor
+
+import "syscall"
+
+// ignoring_eintr calls f again for as long as it fails with EINTR. Go
+// installs its signal handlers with SA_RESTART, but that doesn't cover
+// every syscall, and with signals being forwarded all the time one may
+// well arrive in the middle of one.
+func ignoring_eintr(f func() error) error {
+	for {
+		if err := f(); err != syscall.EINTR {
+			return err
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package supervisor
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Variables set in the environment of every child, unless Options.Env
+// already sets them.
+const (
+	// The role of the child.
+	EnvRole = "MRUN_ROLE"
+	// How many times the stage has been started before, 0 the first
+	// time.
+	EnvRestartCount = "MRUN_RESTART_COUNT"
+	// The PID of the sibling, if it is running when the child starts:
+	// the stage it reads from, or for the first one the stage it writes
+	// to; in a fan-in pipeline the producers' sibling is the consumer.
+	EnvSiblingPid = "MRUN_SIBLING_PID"
+)
+
+// Environ returns our environment without the variables set for the
+// children, so that those of a parent mrun don't look like settings.
+// It is what an Options.Env of nil stands for.
+func Environ() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		key, _, _ := strings.Cut(kv, "=")
+		if key != EnvRole && key != EnvRestartCount && key != EnvSiblingPid {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
+// child_env returns the environment of the child of stage.
+func (s *Supervisor) child_env(stage Stage) []string {
+	s.children_mu.Lock()
+	starts := s.starts[stage.Role]
+	sibling := s.forked[s.sibling(stage.Role)]
+	s.children_mu.Unlock()
+
+	env := append([]string{}, s.opts.Env...)
+	set := func(key string, value any) {
+		if !env_has(s.opts.Env, key) {
+			env = append(env, fmt.Sprintf("%s=%v", key, value))
+		}
+	}
+	set(EnvRole, stage.Role)
+	set(EnvRestartCount, starts)
+	if sibling != 0 {
+		set(EnvSiblingPid, sibling)
+	}
+	return env
+}
+
+// forked_child notes that the child proc of role has been started, and
+// returns the channel that is closed to stop it for RestartStage.
+func (s *Supervisor) forked_child(role string, proc Process) chan struct{} {
+	s.children_mu.Lock()
+	defer s.children_mu.Unlock()
+	pid := uintptr(proc.Pid())
+	s.processes[pid] = proc
+	s.starts[role]++
+	s.forked[role] = pid
+	stop := make(chan struct{})
+	s.stop_child[pid] = stop
+	return stop
+}
+
+// reaped_child notes that the child pid of role is gone.
+func (s *Supervisor) reaped_child(role string, pid uintptr) {
+	s.children_mu.Lock()
+	defer s.children_mu.Unlock()
+	if s.forked[role] == pid {
+		delete(s.forked, role)
+	}
+	delete(s.stop_child, pid)
+	delete(s.processes, pid)
+}
+
+// request_stop has the watch routine of the child pid stop it, once.
+func (s *Supervisor) request_stop(pid uintptr) bool {
+	s.children_mu.Lock()
+	defer s.children_mu.Unlock()
+	stop, ok := s.stop_child[pid]
+	if ok {
+		close(stop)
+		delete(s.stop_child, pid)
+	}
+	return ok
+}
+
+// sibling returns the role of the sibling of role, see EnvSiblingPid.
+func (s *Supervisor) sibling(role string) string {
+	stages := s.opts.Stages
+	i := stage_index(stages, role)
+	last := len(stages) - 1
+	switch {
+	case i < 0 || last == 0:
+		return ""
+	case s.opts.Topology == FanIn && i < last:
+		return stages[last].Role
+	case i == 0:
+		return stages[1].Role
+	case s.opts.Topology == FanOut:
+		return stages[0].Role
+	}
+	return stages[i-1].Role
+}
+
+// env_has reports whether env sets key.
+func env_has(env []string, key string) bool {
+	for _, kv := range env {
+		if strings.HasPrefix(kv, key+"=") {
+			return true
+		}
+	}
+	return false
+}
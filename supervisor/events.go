@@ -0,0 +1,81 @@
+package supervisor
+
+import (
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// EventType says what an Event is about.
+type EventType string
+
+const (
+	// A child has been started.
+	EventStarted EventType = "started"
+	// A child has exited, on its own or because it was stopped.
+	EventExited EventType = "exited"
+	// The pipeline, or under Options.IndependentRestart just the stage
+	// Role, is about to be restarted after Role exited. Role is empty
+	// for a Restart.
+	EventRestarting EventType = "restarting"
+	// The pipeline is being stopped for good.
+	EventShuttingDown EventType = "shutting_down"
+	// Run is returning. This is the last event.
+	EventStopped EventType = "stopped"
+)
+
+// How many events are kept for a reader that is behind before new ones
+// are dropped.
+const events_buffer = 1024
+
+// Event is a change in the life of the pipeline, see Supervisor.Events.
+type Event struct {
+	Time time.Time `json:"timestamp"`
+	Type EventType `json:"event"`
+	Role string    `json:"role,omitempty"`
+	Pid  uintptr   `json:"pid,omitempty"`
+	// How an exited child ended, as in the logs: the exit status, -1 if
+	// it was killed, and the signal that killed it.
+	ExitStatus *int   `json:"exit_status,omitempty"`
+	Signal     string `json:"signal,omitempty"`
+	// For restarting, how long until the restart.
+	DelaySeconds float64 `json:"delay_seconds,omitempty"`
+	// For stopped, the error Run returns.
+	Error string `json:"error,omitempty"`
+}
+
+// Events returns the channel the lifecycle events are sent on. It is
+// closed once Run returns. Events that the reader doesn't keep up with
+// are dropped once the channel is full.
+func (s *Supervisor) Events() <-chan Event {
+	return s.events
+}
+
+// emit sends ev, dropping it if nobody reads the events.
+func (s *Supervisor) emit(ev Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	select {
+	case s.events <- ev:
+	default:
+		log.Debugf("Dropping the %s event of %s, nobody reads them", ev.Type, ev.Role)
+	}
+}
+
+// exit_event returns the event for role, PID pid, having ended with
+// status.
+func exit_event(role string, pid uintptr, status syscall.WaitStatus) Event {
+	exit := status.ExitStatus()
+	ev := Event{Type: EventExited, Role: role, Pid: pid, ExitStatus: &exit}
+	if status.Signaled() {
+		ev.Signal = unix.SignalName(status.Signal())
+	}
+	return ev
+}
+
+// close_events closes the events channel, once.
+func (s *Supervisor) close_events() {
+	s.events_once.Do(func() { close(s.events) })
+}
@@ -0,0 +1,140 @@
+package supervisor
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"syscall"
+)
+
+// No Go code runs in a child between fork and exec, so a child that
+// needs setting up there, e.g. with resource limits, is started as a
+// copy of ourselves instead. The init below notices, sets the child up
+// and execs the stage's program in its place, before anything else of
+// the program runs. The PID, argv and fds stay those of the stage. It
+// only switches to Options.Credentials once it is done, so that it can
+// still take privileges away.
+
+// Carries the child_setup to the copy.
+const setup_env = "MRUN_CHILD_SETUP"
+
+// Exit status of a child that could not be set up, like a shell's for a
+// command it can't run.
+const setup_failed = 127
+
+// Rlimit caps a resource of every child, both the soft and the hard
+// limit, e.g. Rlimit{unix.RLIMIT_NOFILE, 1024}.
+type Rlimit struct {
+	Resource int
+	Max      uint64
+}
+
+// child_setup is what is done in a child before it execs Path.
+type child_setup struct {
+	Path         string
+	Rlimits      []Rlimit `json:",omitempty"`
+	Nice         *int     `json:",omitempty"`
+	NiceRequired bool     `json:",omitempty"`
+	OOMScoreAdj  *int     `json:",omitempty"`
+	Umask        *int     `json:",omitempty"`
+	// Switched to last, nil keeps ours.
+	Credential *syscall.Credential `json:",omitempty"`
+}
+
+// needed reports whether there is anything to set up.
+func (c *child_setup) needed() bool {
+	return len(c.Rlimits) > 0 || c.Nice != nil || c.OOMScoreAdj != nil || c.Umask != nil
+}
+
+// setup returns what has to be done in the child of stage.
+func (s *Supervisor) setup(stage Stage) *child_setup {
+	return &child_setup{
+		Path:         stage.Path,
+		Rlimits:      s.opts.Rlimits,
+		Nice:         stage.Nice,
+		NiceRequired: s.opts.NiceRequired,
+		OOMScoreAdj:  stage.OOMScoreAdj,
+		Umask:        s.opts.Umask,
+		Credential:   s.opts.Credentials.credential(),
+	}
+}
+
+// exec_path returns the program to fork for stage, its environment and
+// the credentials to fork it with.
+func (s *Supervisor) exec_path(stage Stage) (string, []string, *syscall.Credential, error) {
+	setup := s.setup(stage)
+	env := s.child_env(stage)
+	if !setup.needed() {
+		return stage.Path, env, setup.Credential, nil
+	}
+	data, err := json.Marshal(setup)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	env = append(env, setup_env+"="+string(data))
+	return "/proc/self/exe", env, nil, nil
+}
+
+func init() {
+	data, ok := os.LookupEnv(setup_env)
+	if !ok {
+		return
+	}
+	os.Unsetenv(setup_env)
+	// The niceness is that of the thread, the one that goes on to exec.
+	runtime.LockOSThread()
+	var setup child_setup
+	if err := json.Unmarshal([]byte(data), &setup); err != nil {
+		setup_exit("bad %s: %v", setup_env, err)
+	}
+	for _, limit := range setup.Rlimits {
+		rlimit := syscall.Rlimit{Cur: limit.Max, Max: limit.Max}
+		if err := syscall.Setrlimit(limit.Resource, &rlimit); err != nil {
+			setup_exit("cannot set resource limit %d to %d: %v", limit.Resource, limit.Max, err)
+		}
+	}
+	if setup.Nice != nil {
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, 0, *setup.Nice); err != nil {
+			if setup.NiceRequired {
+				setup_exit("cannot set the niceness to %d: %v", *setup.Nice, err)
+			}
+			fmt.Fprintf(os.Stderr, "mrun: cannot set the niceness to %d, running at ours: %v\n", *setup.Nice, err)
+		}
+	}
+	if setup.OOMScoreAdj != nil {
+		// Linux only, elsewhere this fails like any other write.
+		adj := strconv.Itoa(*setup.OOMScoreAdj)
+		if err := os.WriteFile("/proc/self/oom_score_adj", []byte(adj), 0); err != nil {
+			fmt.Fprintf(os.Stderr, "mrun: cannot set the OOM score adjustment to %s: %v\n", adj, err)
+		}
+	}
+	if setup.Umask != nil {
+		syscall.Umask(*setup.Umask)
+	}
+	if cred := setup.Credential; cred != nil {
+		groups := make([]int, len(cred.Groups))
+		for i, gid := range cred.Groups {
+			groups[i] = int(gid)
+		}
+		if err := syscall.Setgroups(groups); err != nil {
+			setup_exit("cannot set the groups: %v", err)
+		}
+		if err := syscall.Setgid(int(cred.Gid)); err != nil {
+			setup_exit("cannot switch to group %d: %v", cred.Gid, err)
+		}
+		if err := syscall.Setuid(int(cred.Uid)); err != nil {
+			setup_exit("cannot switch to user %d: %v", cred.Uid, err)
+		}
+	}
+	err := ignoring_eintr(func() error { return syscall.Exec(setup.Path, os.Args, os.Environ()) })
+	setup_exit("cannot exec %s: %v", setup.Path, err)
+}
+
+// setup_exit ends a child that could not be set up, rather than let it
+// run without.
+func setup_exit(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, "mrun: "+format+"\n", args...)
+	os.Exit(setup_failed)
+}
@@ -0,0 +1,21 @@
+package supervisor
+
+// Fields are structured key/values attached to a log message.
+type Fields map[string]interface{}
+
+// FieldMessage is a log message carrying structured fields. The text
+// formats only show the message, a JSON format can also emit the fields.
+type FieldMessage struct {
+	Message string
+	Fields  Fields
+}
+
+func (m FieldMessage) String() string {
+	return m.Message
+}
+
+// WithFields attaches fields to msg, for use as the only argument to
+// one of the non-f log calls, e.g. log.Info(WithFields(...)).
+func WithFields(msg string, fields Fields) FieldMessage {
+	return FieldMessage{Message: msg, Fields: fields}
+}
@@ -0,0 +1,75 @@
+package supervisor
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// make_fifo makes sure Options.FIFO is a named pipe, creating it if it
+// doesn't exist yet. It returns whether it did, for remove_fifo.
+func (s *Supervisor) make_fifo() (bool, error) {
+	path := s.opts.FIFO
+	info, err := os.Stat(path)
+	if err == nil {
+		if info.Mode()&os.ModeNamedPipe == 0 {
+			return false, fmt.Errorf("%s exists and isn't a FIFO", path)
+		}
+		return false, nil
+	}
+	if !os.IsNotExist(err) {
+		return false, err
+	}
+	if err := unix.Mkfifo(path, 0600); err != nil {
+		return false, fmt.Errorf("cannot create the FIFO %s: %v", path, err)
+	}
+	log.Infof("Created the FIFO %s", path)
+	return true, nil
+}
+
+// remove_fifo removes the FIFO, if make_fifo created it and
+// Options.KeepFIFO isn't set.
+func (s *Supervisor) remove_fifo(created bool) {
+	if !created || s.opts.KeepFIFO {
+		return
+	}
+	if err := os.Remove(s.fifo); err != nil {
+		log.Warningf("Cannot remove the FIFO: %v", err)
+	}
+}
+
+// open_fifo opens both ends of the FIFO, for the producer to write to
+// and the consumer to read from, in the form make_pipes returns.
+//
+// Opening one end of a FIFO blocks until the other one is opened, so
+// the read end is opened without blocking first, which makes the open of
+// the write end return straight away, and then made blocking again for
+// the consumer.
+func (s *Supervisor) open_fifo() ([][2]int, error) {
+	var r, w int
+	err := ignoring_eintr(func() (err error) {
+		r, err = unix.Open(s.fifo, unix.O_RDONLY|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot open the FIFO: %v", err)
+	}
+	err = ignoring_eintr(func() (err error) {
+		w, err = unix.Open(s.fifo, unix.O_WRONLY|unix.O_CLOEXEC, 0)
+		return err
+	})
+	if err != nil {
+		unix.Close(r)
+		return nil, fmt.Errorf("cannot open the FIFO: %v", err)
+	}
+	if err := unix.SetNonblock(r, false); err != nil {
+		unix.Close(r)
+		unix.Close(w)
+		return nil, fmt.Errorf("cannot open the FIFO: %v", err)
+	}
+	if s.opts.PipeSize > 0 {
+		s.set_pipe_size(w)
+	}
+	return [][2]int{{r, w}}, nil
+}
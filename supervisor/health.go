@@ -0,0 +1,78 @@
+package supervisor
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// watch_health runs stage.HealthCommand every Options.HealthInterval
+// while the child pid is running, with MRUN_PID set to its PID and the
+// environment, working directory and credentials of the stage. A probe
+// that fails or takes longer than the interval counts as a failure, and
+// unhealthy is closed after Options.HealthRetries of them in a row. It
+// returns once ctx is cancelled.
+func (s *Supervisor) watch_health(ctx context.Context, stage Stage, pid uintptr, unhealthy chan struct{}) {
+	ticker := time.NewTicker(s.opts.HealthInterval)
+	defer ticker.Stop()
+	failures := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := s.probe(ctx, stage, pid)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			if failures > 0 {
+				log.Infof("%s (PID %d) is healthy again", stage.Role, pid)
+			}
+			failures = 0
+			continue
+		}
+		failures++
+		s.metrics.HealthFailed(stage.Role)
+		log.Warning(WithFields(fmt.Sprintf("Health check of %s (PID %d) failed (%d of %d): %v", stage.Role, pid, failures, s.opts.HealthRetries, err),
+			Fields{"role": stage.Role, "pid": pid, "failures": failures}))
+		if failures >= s.opts.HealthRetries {
+			close(unhealthy)
+			return
+		}
+	}
+}
+
+// probe runs stage.HealthCommand once for the child pid.
+func (s *Supervisor) probe(ctx context.Context, stage Stage, pid uintptr) error {
+	ctx, cancel := context.WithTimeout(ctx, s.opts.HealthInterval)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, stage.HealthCommand[0], stage.HealthCommand[1:]...)
+	cmd.Env = append(append([]string{}, s.opts.Env...), fmt.Sprintf("MRUN_PID=%d", pid))
+	cmd.Dir = stage.Dir
+	cmd.SysProcAttr = &syscall.SysProcAttr{Credential: s.opts.Credentials.credential()}
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %v", s.opts.HealthInterval)
+	}
+	if err != nil && len(out) > 0 {
+		return fmt.Errorf("%v: %s", err, trim_output(out))
+	}
+	return err
+}
+
+// trim_output shortens the output of a failed probe for the log.
+func trim_output(out []byte) string {
+	const max = 200
+	s := string(out)
+	for len(s) > 0 && (s[len(s)-1] == '\n' || s[len(s)-1] == '\r') {
+		s = s[:len(s)-1]
+	}
+	if len(s) > max {
+		s = s[:max] + "..."
+	}
+	return s
+}
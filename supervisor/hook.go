@@ -0,0 +1,74 @@
+package supervisor
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// run_hook runs command, looked up in PATH, with the children's
+// environment plus env, and waits for it. Its output goes to our
+// stderr. The hook runs in a process group of its own, which is killed
+// with SIGKILL if ctx is cancelled.
+func (s *Supervisor) run_hook(ctx context.Context, name string, command []string, env ...string) error {
+	log.Infof("Running the %s hook: %v", name, command)
+	start := time.Now()
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Env = append(append([]string{}, s.opts.Env...), env...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("the %s hook failed: %v", name, err)
+	}
+	log.Debugf("The %s hook took %v", name, time.Since(start))
+	return nil
+}
+
+// on_restart runs Options.OnRestart, if set, after ev and before the
+// stage is started again, for at most Options.HookTimeout. A failure
+// only ends Run with Options.OnRestartRequired.
+func (s *Supervisor) on_restart(ctx context.Context, ev ChildEvent) error {
+	if len(s.opts.OnRestart) == 0 {
+		return nil
+	}
+	hook_ctx := ctx
+	if s.opts.HookTimeout > 0 {
+		var cancel context.CancelFunc
+		hook_ctx, cancel = context.WithTimeout(ctx, s.opts.HookTimeout)
+		defer cancel()
+	}
+	err := s.run_hook(hook_ctx, "on-restart", s.opts.OnRestart,
+		"MRUN_ROLE="+ev.Role, fmt.Sprintf("MRUN_EXIT=%d", exit_code(ev.Status)))
+	if err == nil || ctx.Err() != nil {
+		return nil
+	}
+	if hook_ctx.Err() != nil {
+		// run_hook has killed and reaped it.
+		log.Warningf("The on-restart hook did not finish within %v, killed it, restarting anyway", s.opts.HookTimeout)
+		return nil
+	}
+	if s.opts.OnRestartRequired {
+		log.Errorf("%v, giving up", err)
+		return err
+	}
+	log.Warningf("%v, restarting anyway", err)
+	return nil
+}
+
+// post_stop runs Options.PostStop, if set, once the pipeline has stopped
+// for good. It isn't cut short by a stop, that is what it is for.
+func (s *Supervisor) post_stop() {
+	if len(s.opts.PostStop) == 0 {
+		return
+	}
+	if err := s.run_hook(context.Background(), "post-stop", s.opts.PostStop); err != nil {
+		log.Error(err)
+	}
+}
@@ -0,0 +1,164 @@
+package supervisor
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Launcher starts the children. The default, used when
+// Options.Launcher is nil, forks and execs them; another one can stand
+// in for it, e.g. to test the restart policy without any real processes,
+// see the supervisortest package.
+type Launcher interface {
+	// Start starts a child as spec says and returns once it is running,
+	// or failed to start.
+	Start(spec ProcSpec) (Process, error)
+}
+
+// Process is a child started by a Launcher.
+type Process interface {
+	Pid() int
+	// Signal sends sig to the child, and to its process group if it has
+	// one of its own.
+	Signal(sig syscall.Signal) error
+	// Wait returns the status of the child once it has exited, and
+	// makes sure it doesn't linger as a zombie. It is called once.
+	Wait() (syscall.WaitStatus, error)
+	// HasExited reports whether the child has exited, even if Wait
+	// hasn't returned yet.
+	HasExited() bool
+}
+
+// ProcSpec is a child to start.
+type ProcSpec struct {
+	// The role of the stage the child runs.
+	Role string
+	// The program to exec, which may be a copy of ourselves that sets
+	// the child up first, see exec.go, and its arguments including the
+	// first.
+	Path string
+	Argv []string
+	Dir  string
+	Env  []string
+	// The child's fds, from 0: stdin, stdout and stderr.
+	Files      []uintptr
+	Credential *syscall.Credential
+	// Whether the child gets a process group of its own. What it leaves
+	// in that once it has exited gets StopSignal.
+	ProcessGroup bool
+	StopSignal   syscall.Signal
+}
+
+// launcher returns the Launcher to start the children with.
+func (s *Supervisor) launcher() Launcher {
+	if s.opts.Launcher != nil {
+		return s.opts.Launcher
+	}
+	return fork_exec{}
+}
+
+// fork_exec is the Launcher that starts real processes.
+//
+// The fork and exec happen in one go in syscall.ForkExec, no Go code
+// runs in the child. Every other fd we hold has to be close-on-exec so
+// the child doesn't inherit it. ForkExec only returns once the child has
+// exec'd or failed to, so by the time Start returns the child holds its
+// own copies of its files.
+type fork_exec struct{}
+
+func (fork_exec) Start(spec ProcSpec) (Process, error) {
+	attr := &syscall.ProcAttr{
+		Dir:   spec.Dir,
+		Env:   spec.Env,
+		Files: spec.Files,
+		Sys: &syscall.SysProcAttr{
+			Credential: spec.Credential,
+			Setpgid:    spec.ProcessGroup,
+		},
+	}
+	var pid int
+	err := ignoring_eintr(func() (err error) {
+		pid, err = syscall.ForkExec(spec.Path, spec.Argv, attr)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &forked{pid: pid, group: spec.ProcessGroup, stop_signal: spec.StopSignal}, nil
+}
+
+// forked is a child started by fork_exec.
+type forked struct {
+	pid         int
+	group       bool
+	stop_signal syscall.Signal
+}
+
+func (p *forked) Pid() int {
+	return p.pid
+}
+
+func (p *forked) Signal(sig syscall.Signal) error {
+	if p.group {
+		return syscall.Kill(-p.pid, sig)
+	}
+	return syscall.Kill(p.pid, sig)
+}
+
+// HasExited also counts a child that is still exiting: it closes its
+// files, so that e.g. the next stage sees EOF, before it is a zombie.
+func (p *forked) HasExited() bool {
+	var info unix.Siginfo
+	err := ignoring_eintr(func() error {
+		return unix.Waitid(unix.P_PID, p.pid, &info, unix.WEXITED|unix.WNOWAIT|unix.WNOHANG, nil)
+	})
+	// ECHILD once Wait has reaped it.
+	if err == unix.ECHILD || (err == nil && info.Signo != 0) {
+		return true
+	}
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", p.pid))
+	if err != nil {
+		return false
+	}
+	// The flags are the 9th field, the 7th after the command name.
+	fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+	if len(fields) < 7 {
+		return false
+	}
+	flags, _ := strconv.ParseUint(fields[6], 10, 64)
+	return flags&pf_exiting != 0
+}
+
+// PF_EXITING in the flags of /proc/PID/stat, set as a process starts to
+// exit.
+const pf_exiting = 0x4
+
+// Wait reaps the child, see wait_until.
+//
+// A child in its own process group may leave processes behind in it,
+// holding its pipes open. Those get the stop signal once the child has
+// exited, but before it is reaped, so the group id can't have been reused
+// yet.
+func (p *forked) Wait() (syscall.WaitStatus, error) {
+	if p.group {
+		wait_until(func() (bool, error) {
+			// Only filled in once the child has exited.
+			var info unix.Siginfo
+			err := unix.Waitid(unix.P_PID, p.pid, &info, unix.WEXITED|unix.WNOWAIT|unix.WNOHANG, nil)
+			return info.Signo != 0, err
+		})
+		syscall.Kill(-p.pid, p.stop_signal)
+	}
+	var status syscall.WaitStatus
+	err := wait_until(func() (bool, error) {
+		pid, err := syscall.Wait4(p.pid, &status, syscall.WNOHANG, nil)
+		return pid == p.pid, err
+	})
+	return status, err
+}
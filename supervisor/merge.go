@@ -0,0 +1,115 @@
+package supervisor
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"sync"
+)
+
+// Merge interleaves the output of several producers onto the consumer's
+// stdin a line at a time, so lines from different producers never end
+// up mixed together. Lines longer than the read buffer are passed on in
+// pieces. The consumer's stdin is closed once the last producer has hit
+// EOF and won't be restarted, or when the pipeline stops.
+type Merge struct {
+	sup    *Supervisor
+	mu     sync.Mutex
+	out    *os.File
+	broken bool
+	closed bool
+	// The producers being copied from.
+	active int
+	wg     sync.WaitGroup
+}
+
+func new_merge(sup *Supervisor, out *os.File) *Merge {
+	return &Merge{sup: sup, out: out}
+}
+
+// Add starts copying lines from src, until it hits EOF.
+func (m *Merge) Add(role string, src *os.File) {
+	m.mu.Lock()
+	m.active++
+	m.mu.Unlock()
+	m.wg.Add(1)
+	go m.copy_lines(role, src)
+}
+
+func (m *Merge) copy_lines(role string, src *os.File) {
+	defer m.wg.Done()
+	defer m.finished(role)
+	defer src.Close()
+	r := bufio.NewReaderSize(src, 64*1024)
+	for {
+		line, err := r.ReadSlice('\n')
+		if len(line) > 0 {
+			if err == io.EOF {
+				// Terminate a final partial line so it doesn't run
+				// into the next producer's output.
+				line = append(append([]byte{}, line...), '\n')
+			}
+			m.write(line)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Errorf("Reading from %s failed: %v", role, err)
+			}
+			return
+		}
+	}
+}
+
+// finished closes the consumer's stdin once role, the last producer
+// still being copied from, won't be restarted: under Once the run only
+// ends when the consumer has exited as well.
+func (m *Merge) finished(role string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.active--
+	if m.active == 0 && (m.sup.opts.Policy == Once || m.sup.opts.policy(role) != Restart) {
+		m.close()
+	}
+}
+
+// close closes the consumer's stdin, once. Called with m.mu held.
+func (m *Merge) close() {
+	if !m.closed {
+		m.closed = true
+		m.out.Close()
+	}
+}
+
+func (m *Merge) write(p []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.broken || m.closed {
+		return
+	}
+	if _, err := m.out.Write(p); err != nil {
+		log.Debugf("consumer stopped reading: %v", err)
+		m.broken = true
+	}
+}
+
+// Respawn starts a producer again on a new pipe, see start_merge_producer.
+func (m *Merge) Respawn(ctx context.Context, stage Stage, comms chan ChildEvent) (int, error) {
+	pipes, err := m.sup.make_data_pipes(1)
+	if err != nil {
+		return -1, err
+	}
+	return m.sup.start_merge_producer(ctx, stage, m, pipes[0], comms), nil
+}
+
+// Wait blocks until every producer has hit EOF, then closes the
+// consumer's stdin.
+func (m *Merge) Wait() {
+	m.wg.Wait()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.close()
+}
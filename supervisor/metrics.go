@@ -0,0 +1,415 @@
+package supervisor
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Upper bounds in seconds of the run duration histogram buckets.
+var run_duration_buckets = []float64{1, 10, 60, 300, 1800, 3600, 21600, 86400}
+
+// Metrics holds the supervision counters of a Supervisor.
+type Metrics struct {
+	mu          sync.Mutex
+	started     time.Time
+	restarts    map[string]uint64
+	pids        map[string]uintptr
+	run_buckets []uint64
+	run_sum     float64
+	run_count   uint64
+	pumped      map[string]PumpCounts
+	// Bytes of the output on the consumer's connection to the bridge,
+	// compressed, see Options.Compress.
+	compressed map[string]uint64
+	stalls     map[string]uint64
+	unhealthy  map[string]uint64
+	// The current run of each stage, and the last one that ended.
+	runs     map[string]stage_run
+	listener MetricsListener
+}
+
+// MetricsListener is told about every restart and pipeline run as the
+// Metrics count them, e.g. to pass them on to StatsD. Its methods are
+// called with the Metrics locked and must not block.
+type MetricsListener interface {
+	Restarted(role string)
+	ObservedRun(d time.Duration)
+}
+
+// stage_run is when the child pid of a stage was started, zero once it
+// has exited, and when and how the one before it, or it, last exited.
+type stage_run struct {
+	pid         uintptr
+	started     time.Time
+	exited      time.Time
+	exit_status int
+}
+
+func new_metrics() *Metrics {
+	return &Metrics{
+		started:     time.Now(),
+		restarts:    make(map[string]uint64),
+		pids:        make(map[string]uintptr),
+		run_buckets: make([]uint64, len(run_duration_buckets)),
+		pumped:      make(map[string]PumpCounts),
+		compressed:  make(map[string]uint64),
+		stalls:      make(map[string]uint64),
+		unhealthy:   make(map[string]uint64),
+		runs:        make(map[string]stage_run),
+	}
+}
+
+// Listen makes l the MetricsListener, nil for none.
+func (m *Metrics) Listen(l MetricsListener) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.listener = l
+}
+
+// AddRole makes role show up in the metrics before it has ever started.
+func (m *Metrics) AddRole(role string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.restarts[role]; !ok {
+		m.restarts[role] = 0
+		m.pids[role] = 0
+	}
+}
+
+// Restarted counts a restart caused by role exiting.
+func (m *Metrics) Restarted(role string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.restarts[role]++
+	if m.listener != nil {
+		m.listener.Restarted(role)
+	}
+}
+
+// SetPid records the current PID of role, 0 while it isn't running.
+func (m *Metrics) SetPid(role string, pid uintptr) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pids[role] = pid
+}
+
+// ObserveRun records how long a pipeline run lasted.
+func (m *Metrics) ObserveRun(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	seconds := d.Seconds()
+	for i, bound := range run_duration_buckets {
+		if seconds <= bound {
+			m.run_buckets[i]++
+		}
+	}
+	m.run_sum += seconds
+	m.run_count++
+	if m.listener != nil {
+		m.listener.ObservedRun(d)
+	}
+}
+
+// Forked records that the child pid of role was started at at.
+func (m *Metrics) Forked(role string, pid uintptr, at time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	run := m.runs[role]
+	run.pid, run.started = pid, at
+	m.runs[role] = run
+}
+
+// Reaped records that the child pid of role exited at at with status.
+// The run of a newer child of role, e.g. one replacing it, goes on.
+func (m *Metrics) Reaped(role string, pid uintptr, at time.Time, status syscall.WaitStatus) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	run := m.runs[role]
+	if run.pid == pid {
+		run.pid, run.started = 0, time.Time{}
+	}
+	run.exited, run.exit_status = at, status.ExitStatus()
+	m.runs[role] = run
+}
+
+// stage_status fills in the per stage times and exit statuses of status.
+func (m *Metrics) stage_status(status *Status) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	status.StartedAt = make(map[string]time.Time)
+	status.StageUptimeSeconds = make(map[string]float64)
+	status.LastExitTime = make(map[string]time.Time)
+	status.LastExitStatus = make(map[string]int)
+	for role, run := range m.runs {
+		if !run.started.IsZero() {
+			status.StartedAt[role] = run.started
+			status.StageUptimeSeconds[role] = time.Since(run.started).Seconds()
+		}
+		if !run.exited.IsZero() {
+			status.LastExitTime[role] = run.exited
+			status.LastExitStatus[role] = run.exit_status
+		}
+	}
+}
+
+// Pumped counts bytes and lines copied from role to the next stage.
+func (m *Metrics) Pumped(role string, bytes int, lines int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	counts := m.pumped[role]
+	counts.Bytes += uint64(bytes)
+	counts.Lines += uint64(lines)
+	m.pumped[role] = counts
+}
+
+// Compressed counts bytes of the output of role after compression, as
+// the consumer's connection to the bridge carries them.
+func (m *Metrics) Compressed(role string, bytes int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.compressed[role] += uint64(bytes)
+}
+
+// Stalled counts a stall of role, see Options.StallTimeout.
+func (m *Metrics) Stalled(role string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stalls[role]++
+}
+
+// HealthFailed counts a failed health check of role, see
+// Stage.HealthCommand.
+func (m *Metrics) HealthFailed(role string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.unhealthy[role]++
+}
+
+// PumpedCounts returns a copy of the pump counters, nil if nothing has
+// been pumped.
+func (m *Metrics) PumpedCounts() map[string]PumpCounts {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.pumped) == 0 {
+		return nil
+	}
+	return maps.Clone(m.pumped)
+}
+
+// Totals returns the restarts of each role, and the last exit status of
+// each role that has exited, e.g. to sum up a run once Run has returned.
+func (m *Metrics) Totals() (map[string]uint64, map[string]int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	last_exit := make(map[string]int)
+	for role, run := range m.runs {
+		if !run.exited.IsZero() {
+			last_exit[role] = run.exit_status
+		}
+	}
+	return maps.Clone(m.restarts), last_exit
+}
+
+// unix_seconds returns t in seconds since the epoch, 0 for the zero
+// time.
+func unix_seconds(t time.Time) float64 {
+	if t.IsZero() {
+		return 0
+	}
+	return float64(t.UnixNano()) / 1e9
+}
+
+func sorted_keys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// WriteText writes the metrics in the Prometheus text exposition format.
+func (m *Metrics) WriteText(w io.Writer) {
+	write_text(w, []labelled_metrics{{"", m}})
+}
+
+// WriteLabeledText writes the metrics of several supervisors like
+// WriteText, each with label set to its key, e.g. pipeline="web".
+func WriteLabeledText(w io.Writer, label string, metrics map[string]*Metrics) {
+	var sets []labelled_metrics
+	for _, value := range sorted_keys(metrics) {
+		sets = append(sets, labelled_metrics{fmt.Sprintf("%s=%q", label, value), metrics[value]})
+	}
+	write_text(w, sets)
+}
+
+// labelled_metrics is a Metrics and the label pair to add to every
+// sample of it, "" for none.
+type labelled_metrics struct {
+	label string
+	m     *Metrics
+}
+
+// labels returns the label set of a sample of l with the pairs in more.
+func (l labelled_metrics) labels(more ...string) string {
+	if l.label != "" {
+		more = append([]string{l.label}, more...)
+	}
+	if len(more) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(more, ",") + "}"
+}
+
+func role_label(role string) string {
+	return fmt.Sprintf("role=%q", role)
+}
+
+// write_text writes sets, each family once with the samples of all of
+// them.
+func write_text(w io.Writer, sets []labelled_metrics) {
+	for _, set := range sets {
+		set.m.mu.Lock()
+		defer set.m.mu.Unlock()
+	}
+	restarts := make(map[string]bool)
+	for _, set := range sets {
+		for role := range set.m.restarts {
+			restarts[role] = true
+		}
+	}
+	for _, role := range sorted_keys(restarts) {
+		name := fmt.Sprintf("mrun_%s_restarts_total", strings.ReplaceAll(role, "-", "_"))
+		fmt.Fprintf(w, "# HELP %s Restarts caused by the %s exiting.\n", name, role)
+		fmt.Fprintf(w, "# TYPE %s counter\n", name)
+		for _, set := range sets {
+			if count, ok := set.m.restarts[role]; ok {
+				fmt.Fprintf(w, "%s%s %d\n", name, set.labels(), count)
+			}
+		}
+	}
+
+	fmt.Fprintf(w, "# HELP mrun_child_pid Current PID of each child, 0 when not running.\n")
+	fmt.Fprintf(w, "# TYPE mrun_child_pid gauge\n")
+	for _, set := range sets {
+		for _, role := range sorted_keys(set.m.pids) {
+			fmt.Fprintf(w, "mrun_child_pid%s %d\n", set.labels(role_label(role)), set.m.pids[role])
+		}
+	}
+
+	fmt.Fprintf(w, "# HELP mrun_uptime_seconds Time since mrun started.\n")
+	fmt.Fprintf(w, "# TYPE mrun_uptime_seconds gauge\n")
+	for _, set := range sets {
+		fmt.Fprintf(w, "mrun_uptime_seconds%s %g\n", set.labels(), time.Since(set.m.started).Seconds())
+	}
+
+	fmt.Fprintf(w, "# HELP mrun_stage_start_time_seconds Start time of the running child of each stage since the epoch, 0 when not running.\n")
+	fmt.Fprintf(w, "# TYPE mrun_stage_start_time_seconds gauge\n")
+	for _, set := range sets {
+		for _, role := range sorted_keys(set.m.pids) {
+			fmt.Fprintf(w, "mrun_stage_start_time_seconds%s %g\n", set.labels(role_label(role)), unix_seconds(set.m.runs[role].started))
+		}
+	}
+	fmt.Fprintf(w, "# HELP mrun_stage_uptime_seconds How long the running child of each stage has been up, 0 when not running.\n")
+	fmt.Fprintf(w, "# TYPE mrun_stage_uptime_seconds gauge\n")
+	for _, set := range sets {
+		for _, role := range sorted_keys(set.m.pids) {
+			uptime := 0.0
+			if started := set.m.runs[role].started; !started.IsZero() {
+				uptime = time.Since(started).Seconds()
+			}
+			fmt.Fprintf(w, "mrun_stage_uptime_seconds%s %g\n", set.labels(role_label(role)), uptime)
+		}
+	}
+	fmt.Fprintf(w, "# HELP mrun_stage_last_exit_time_seconds When each stage last exited, since the epoch.\n")
+	fmt.Fprintf(w, "# TYPE mrun_stage_last_exit_time_seconds gauge\n")
+	for _, set := range sets {
+		for _, role := range sorted_keys(set.m.runs) {
+			if exited := set.m.runs[role].exited; !exited.IsZero() {
+				fmt.Fprintf(w, "mrun_stage_last_exit_time_seconds%s %g\n", set.labels(role_label(role)), unix_seconds(exited))
+			}
+		}
+	}
+	fmt.Fprintf(w, "# HELP mrun_stage_last_exit_status Exit status of the last exit of each stage, -1 if it was killed.\n")
+	fmt.Fprintf(w, "# TYPE mrun_stage_last_exit_status gauge\n")
+	for _, set := range sets {
+		for _, role := range sorted_keys(set.m.runs) {
+			if run := set.m.runs[role]; !run.exited.IsZero() {
+				fmt.Fprintf(w, "mrun_stage_last_exit_status%s %d\n", set.labels(role_label(role)), run.exit_status)
+			}
+		}
+	}
+
+	fmt.Fprintf(w, "# HELP mrun_run_duration_seconds How long each pipeline run lasted.\n")
+	fmt.Fprintf(w, "# TYPE mrun_run_duration_seconds histogram\n")
+	for _, set := range sets {
+		for i, bound := range run_duration_buckets {
+			fmt.Fprintf(w, "mrun_run_duration_seconds_bucket%s %d\n", set.labels(fmt.Sprintf("le=\"%g\"", bound)), set.m.run_buckets[i])
+		}
+		fmt.Fprintf(w, "mrun_run_duration_seconds_bucket%s %d\n", set.labels(`le="+Inf"`), set.m.run_count)
+		fmt.Fprintf(w, "mrun_run_duration_seconds_sum%s %g\n", set.labels(), set.m.run_sum)
+		fmt.Fprintf(w, "mrun_run_duration_seconds_count%s %d\n", set.labels(), set.m.run_count)
+	}
+
+	write_role_counters(w, sets, "mrun_pumped_bytes_total", "Bytes copied from each stage to the next.", func(m *Metrics) map[string]uint64 {
+		counts := make(map[string]uint64, len(m.pumped))
+		for role, pumped := range m.pumped {
+			counts[role] = pumped.Bytes
+		}
+		return counts
+	})
+	write_role_counters(w, sets, "mrun_pumped_lines_total", "Lines copied from each stage to the next.", func(m *Metrics) map[string]uint64 {
+		counts := make(map[string]uint64, len(m.pumped))
+		for role, pumped := range m.pumped {
+			counts[role] = pumped.Lines
+		}
+		return counts
+	})
+	write_role_counters(w, sets, "mrun_compressed_bytes_total", "Bytes of the output of each stage after compression, on the consumer's connection to the bridge.", func(m *Metrics) map[string]uint64 {
+		return m.compressed
+	})
+	header := false
+	for _, set := range sets {
+		for _, role := range sorted_keys(set.m.compressed) {
+			if set.m.compressed[role] == 0 {
+				continue
+			}
+			if !header {
+				fmt.Fprintf(w, "# HELP mrun_compression_ratio Bytes of the output of each stage for every byte of it after compression.\n")
+				fmt.Fprintf(w, "# TYPE mrun_compression_ratio gauge\n")
+				header = true
+			}
+			ratio := float64(set.m.pumped[role].Bytes) / float64(set.m.compressed[role])
+			fmt.Fprintf(w, "mrun_compression_ratio%s %g\n", set.labels(role_label(role)), ratio)
+		}
+	}
+	write_role_counters(w, sets, "mrun_stalls_total", "Times each stage stopped reading its stdin for longer than the stall timeout.", func(m *Metrics) map[string]uint64 {
+		return m.stalls
+	})
+	write_role_counters(w, sets, "mrun_health_check_failures_total", "Failed health checks of each stage.", func(m *Metrics) map[string]uint64 {
+		return m.unhealthy
+	})
+}
+
+// write_role_counters writes the counter family name with a sample per
+// role, if any of sets has one.
+func write_role_counters(w io.Writer, sets []labelled_metrics, name string, help string, counts func(*Metrics) map[string]uint64) {
+	header := false
+	for _, set := range sets {
+		values := counts(set.m)
+		for _, role := range sorted_keys(values) {
+			if !header {
+				fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+				fmt.Fprintf(w, "# TYPE %s counter\n", name)
+				header = true
+			}
+			fmt.Fprintf(w, "%s%s %d\n", name, set.labels(role_label(role)), values[role])
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package supervisor
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// write_pids_file atomically replaces Options.PidsFile with a JSON
+// object mapping every role to the PID of its child, 0 while it isn't
+// running.
+func (s *Supervisor) write_pids_file(running map[string]uintptr) {
+	path := s.opts.PidsFile
+	if path == "" {
+		return
+	}
+	pids := make(map[string]uintptr, len(s.opts.Stages))
+	for _, stage := range s.opts.Stages {
+		pids[stage.Role] = running[stage.Role]
+	}
+	data, err := json.Marshal(pids)
+	if err != nil {
+		log.Errorf("Cannot encode the PIDs: %v", err)
+		return
+	}
+	if err := write_file_atomic(path, append(data, '\n')); err != nil {
+		log.Errorf("Cannot write %s: %v", path, err)
+	}
+}
+
+// remove_pids_file removes Options.PidsFile, if there is one.
+func (s *Supervisor) remove_pids_file() {
+	if s.opts.PidsFile == "" {
+		return
+	}
+	if err := os.Remove(s.opts.PidsFile); err != nil && !os.IsNotExist(err) {
+		log.Warningf("Failed to remove %s: %v", s.opts.PidsFile, err)
+	}
+}
+
+// write_file_atomic writes data to a temporary file next to path and
+// renames it over path, so readers see either the old or the new
+// contents.
+func write_file_atomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
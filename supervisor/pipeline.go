@@ -0,0 +1,281 @@
+package supervisor
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// A Hub sits between the stages of a fan-out or fan-in pipeline, so the
+// stages on its far side can be restarted on their own.
+type Hub interface {
+	// Respawn starts stage again, connected to the hub. It returns the
+	// child's end of its new pipe, for the parent to close once the
+	// child has forked.
+	Respawn(ctx context.Context, stage Stage, comms chan ChildEvent) (int, error)
+	// Wait blocks until the hub has drained after the pipeline stopped.
+	Wait()
+}
+
+// start_pipeline creates the pipes between the stages and starts a
+// watch_stage routine for each. It returns the child ends of the pipes,
+// which the parent has to close once every stage has forked. For a
+// fan-out or fan-in pipeline it also returns the hub in the middle, and
+// for a pumped one the Pump. If
+// it fails, nothing has been started and no fd is left open.
+func (s *Supervisor) start_pipeline(ctx context.Context, pipeline []Stage, comms chan ChildEvent) ([]int, Hub, error) {
+	switch s.opts.Topology {
+	case FanOut:
+		return s.start_fan_out(ctx, pipeline, comms)
+	case FanIn:
+		return s.start_fan_in(ctx, pipeline, comms)
+	}
+	if s.opts.Pump {
+		return s.start_pumped(ctx, pipeline, comms)
+	}
+	if s.bridge != nil && s.opts.TCPAddr != "" {
+		return s.start_bridged(ctx, pipeline, comms)
+	}
+
+	// Create a pipe between each pair of stages, and one back from the
+	// consumer to the producer if Bidirectional.
+	n := len(pipeline) - 1
+	if s.opts.Bidirectional {
+		n++
+	}
+	var pipes [][2]int
+	var err error
+	if s.fifo != "" && s.opts.FIFO != "" {
+		pipes, err = s.open_fifo()
+	} else {
+		pipes, err = s.make_data_pipes(n)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	pipefds := make([]int, 0, 2*len(pipes))
+	for _, fds := range pipes {
+		pipefds = append(pipefds, fds[0], fds[1])
+	}
+
+	stdio := make(map[string][2]int)
+	for i, stage := range pipeline {
+		infd, outfd := -1, -1
+		if i > 0 {
+			infd = pipes[i-1][0]
+		}
+		if i < len(pipeline)-1 {
+			outfd = pipes[i][1]
+		}
+		if s.opts.Bidirectional {
+			back := pipes[len(pipes)-1]
+			if i == 0 {
+				infd = back[0]
+			} else {
+				outfd = back[1]
+			}
+		}
+		stdio[stage.Role] = [2]int{infd, outfd}
+		if i == 0 {
+			go s.start_producer(ctx, stage, pipeline[len(pipeline)-1], infd, outfd, comms)
+			continue
+		}
+		go s.watch_stage(ctx, stage, infd, outfd, comms)
+	}
+	if s.opts.IndependentRestart {
+		return nil, &Pipes{sup: s, stdio: stdio, fds: pipefds}, nil
+	}
+	return pipefds, nil, nil
+}
+
+// Pipes keeps the child ends of the pipes of a linear pipeline open
+// under Options.IndependentRestart, so a stage that exits can be started
+// again on the same pipes while the others keep running. The price is
+// that a stage doesn't see EOF or EPIPE when its neighbour exits, it
+// waits for the replacement instead.
+type Pipes struct {
+	sup *Supervisor
+	// The stdin and stdout of each stage.
+	stdio map[string][2]int
+	// Every fd kept open.
+	fds []int
+	// The Pump of a pumped pipeline.
+	inner Hub
+}
+
+// Respawn starts stage again on its pipes. There is no fd to close once
+// it has forked, so it returns -1. With Options.Spill the stdin of a
+// pumped stage is a new pipe, see Pump.respawn.
+func (p *Pipes) Respawn(ctx context.Context, stage Stage, comms chan ChildEvent) (int, error) {
+	stdio := p.stdio[stage.Role]
+	if pump, ok := p.inner.(*Pump); ok && pump.inputs[stage.Role] != nil {
+		return pump.respawn(ctx, stage, stdio[1], comms)
+	}
+	go p.sup.watch_stage(ctx, stage, stdio[0], stdio[1], comms)
+	return -1, nil
+}
+
+// Wait closes the pipes once the pipeline has stopped, and waits for
+// the Pump if there is one.
+func (p *Pipes) Wait() {
+	for _, fd := range p.fds {
+		syscall.Close(fd)
+	}
+	if p.inner != nil {
+		p.inner.Wait()
+	}
+}
+
+// make_pipes creates n pipes. They are close-on-exec, so each child only
+// keeps the ends dup'd onto its stdin and stdout. Either all of them are
+// created or none: on failure the ones already made are closed again,
+// so nothing has to be started before every pipe exists.
+func make_pipes(n int) ([][2]int, error) {
+	pipes := make([][2]int, 0, n)
+	for i := 0; i < n; i++ {
+		fds := [2]int{}
+		err := ignoring_eintr(func() error { return syscall.Pipe2(fds[:], syscall.O_CLOEXEC) })
+		if err != nil {
+			for _, fds := range pipes {
+				syscall.Close(fds[0])
+				syscall.Close(fds[1])
+			}
+			return nil, err
+		}
+		log.Debugf("Created pipe: read=%d, write=%d", fds[0], fds[1])
+		pipes = append(pipes, fds)
+	}
+	return pipes, nil
+}
+
+// make_data_pipes is make_pipes for the pipes data flows through, which
+// are resized to Options.PipeSize if set.
+func (s *Supervisor) make_data_pipes(n int) ([][2]int, error) {
+	pipes, err := make_pipes(n)
+	if err != nil || s.opts.PipeSize <= 0 {
+		return pipes, err
+	}
+	for _, fds := range pipes {
+		s.set_pipe_size(fds[1])
+	}
+	return pipes, nil
+}
+
+// set_pipe_size resizes the pipe of fd to Options.PipeSize, capped at
+// the system limit for unprivileged users. The kernel rounds the size
+// up, the size we end up with is logged whenever it changes.
+func (s *Supervisor) set_pipe_size(fd int) {
+	size := s.opts.PipeSize
+	if max := pipe_max_size(); max > 0 && size > max {
+		size = max
+	}
+	var got int
+	err := ignoring_eintr(func() (err error) {
+		got, err = unix.FcntlInt(uintptr(fd), unix.F_SETPIPE_SZ, size)
+		return err
+	})
+	if err != nil {
+		log.Warningf("Cannot set the pipe size to %d: %v", size, err)
+		return
+	}
+	if int64(got) != s.pipe_size.Swap(int64(got)) {
+		log.Infof("Pipe size is %d bytes (asked for %d)", got, s.opts.PipeSize)
+	}
+}
+
+// pipe_max_size returns the largest pipe an unprivileged user may ask
+// for, or 0 if it is unknown.
+func pipe_max_size() int {
+	data, err := os.ReadFile("/proc/sys/fs/pipe-max-size")
+	if err != nil {
+		return 0
+	}
+	max, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0
+	}
+	return max
+}
+
+// start_fan_out starts a producer and several consumers with a tee in
+// between, or with Options.Balance a Balancer, so consumers can be
+// restarted on their own.
+func (s *Supervisor) start_fan_out(ctx context.Context, pipeline []Stage, comms chan ChildEvent) ([]int, Hub, error) {
+	// pipes[0] carries the producer's stdout, pipes[i] the stdin of
+	// consumer i.
+	pipes, err := s.make_data_pipes(len(pipeline))
+	if err != nil {
+		return nil, nil, err
+	}
+	go s.watch_stage(ctx, pipeline[0], -1, pipes[0][1], comms)
+	child_fds := []int{pipes[0][1]}
+	if s.opts.Balance {
+		roles := make([]string, 0, len(pipeline)-1)
+		for _, stage := range pipeline[1:] {
+			roles = append(roles, stage.Role)
+		}
+		balancer := new_balancer(s, roles)
+		go balancer.Run(os.NewFile(uintptr(pipes[0][0]), "producer stdout"))
+		for i, stage := range pipeline[1:] {
+			child_fds = append(child_fds, s.start_balanced_consumer(ctx, stage, balancer, pipes[i+1], comms))
+		}
+		return child_fds, balancer, nil
+	}
+	tee := new_tee(s)
+	go tee.Run(os.NewFile(uintptr(pipes[0][0]), "producer stdout"))
+
+	for i, stage := range pipeline[1:] {
+		child_fds = append(child_fds, s.start_tee_consumer(ctx, stage, tee, pipes[i+1], comms))
+	}
+	return child_fds, tee, nil
+}
+
+// start_tee_consumer starts a consumer reading from fds, whose write end
+// is attached to tee. It returns the consumer's end of the pipe, for the
+// parent to close once it has forked.
+func (s *Supervisor) start_tee_consumer(ctx context.Context, stage Stage, tee *Tee, fds [2]int, comms chan ChildEvent) int {
+	go s.watch_stage(ctx, stage, fds[0], -1, comms)
+	tee.Attach(stage.Role, os.NewFile(uintptr(fds[1]), stage.Role+" stdin"))
+	return fds[0]
+}
+
+// start_balanced_consumer is start_tee_consumer for a Balancer.
+func (s *Supervisor) start_balanced_consumer(ctx context.Context, stage Stage, balancer *Balancer, fds [2]int, comms chan ChildEvent) int {
+	go s.watch_stage(ctx, stage, fds[0], -1, comms)
+	balancer.Attach(stage.Role, os.NewFile(uintptr(fds[1]), stage.Role+" stdin"))
+	return fds[0]
+}
+
+// start_fan_in starts several producers and a consumer, with their
+// output merged line by line in between.
+func (s *Supervisor) start_fan_in(ctx context.Context, pipeline []Stage, comms chan ChildEvent) ([]int, Hub, error) {
+	// pipes[i] carries the stdout of producer i, the last one the
+	// consumer's stdin.
+	pipes, err := s.make_data_pipes(len(pipeline))
+	if err != nil {
+		return nil, nil, err
+	}
+	consumer := pipeline[len(pipeline)-1]
+	fds := pipes[len(pipes)-1]
+	go s.watch_stage(ctx, consumer, fds[0], -1, comms)
+	merge := new_merge(s, os.NewFile(uintptr(fds[1]), "consumer stdin"))
+	child_fds := []int{fds[0]}
+
+	for i, stage := range pipeline[:len(pipeline)-1] {
+		child_fds = append(child_fds, s.start_merge_producer(ctx, stage, merge, pipes[i], comms))
+	}
+	return child_fds, merge, nil
+}
+
+// start_merge_producer starts a producer writing to fds, whose read end
+// is read by merge. It returns the producer's end of the pipe, for the
+// parent to close once it has forked.
+func (s *Supervisor) start_merge_producer(ctx context.Context, stage Stage, merge *Merge, fds [2]int, comms chan ChildEvent) int {
+	go s.watch_stage(ctx, stage, -1, fds[1], comms)
+	merge.Add(stage.Role, os.NewFile(uintptr(fds[0]), stage.Role+" stdout"))
+	return fds[1]
+}
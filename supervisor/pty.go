@@ -0,0 +1,123 @@
+package supervisor
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// open_pty opens a new pseudo-terminal and returns its master and slave,
+// like the two ends of a pipe. Output goes through the slave as is,
+// without \n becoming \r\n, and the window has the size of ours.
+func open_pty() ([2]int, error) {
+	master, err := open_cloexec("/dev/ptmx")
+	if err != nil {
+		return [2]int{}, err
+	}
+	slave, err := open_slave(master)
+	if err != nil {
+		unix.Close(master)
+		return [2]int{}, err
+	}
+	log.Debugf("Created pty: master=%d, slave=%d", master, slave)
+	return [2]int{master, slave}, nil
+}
+
+// open_cloexec opens the terminal device path for reading and writing,
+// without it becoming our controlling terminal.
+func open_cloexec(path string) (int, error) {
+	var fd int
+	err := ignoring_eintr(func() (err error) {
+		fd, err = unix.Open(path, unix.O_RDWR|unix.O_NOCTTY|unix.O_CLOEXEC, 0)
+		return err
+	})
+	return fd, err
+}
+
+// open_slave unlocks the slave of master, opens it and sets it up.
+func open_slave(master int) (int, error) {
+	if err := unix.IoctlSetPointerInt(master, unix.TIOCSPTLCK, 0); err != nil {
+		return -1, fmt.Errorf("cannot unlock the pty: %v", err)
+	}
+	n, err := unix.IoctlGetInt(master, unix.TIOCGPTN)
+	if err != nil {
+		return -1, fmt.Errorf("cannot get the pty number: %v", err)
+	}
+	slave, err := open_cloexec(fmt.Sprintf("/dev/pts/%d", n))
+	if err != nil {
+		return -1, err
+	}
+	termios, err := unix.IoctlGetTermios(slave, unix.TCGETS)
+	if err == nil {
+		termios.Oflag &^= unix.OPOST
+		// tcsetattr may wait for output to drain, and be interrupted.
+		err = ignoring_eintr(func() error { return unix.IoctlSetTermios(slave, unix.TCSETS, termios) })
+	}
+	if err != nil {
+		unix.Close(slave)
+		return -1, fmt.Errorf("cannot set the pty up: %v", err)
+	}
+	set_window_size(master)
+	return slave, nil
+}
+
+// set_window_size gives the pty master the window size of our terminal,
+// or 80x24 if we don't have one.
+func set_window_size(master int) {
+	size := &unix.Winsize{Row: 24, Col: 80}
+	for _, fd := range []int{syscall.Stdin, syscall.Stdout, syscall.Stderr} {
+		if ws, err := unix.IoctlGetWinsize(fd, unix.TIOCGWINSZ); err == nil {
+			size = ws
+			break
+		}
+	}
+	if err := unix.IoctlSetWinsize(master, unix.TIOCSWINSZ, size); err != nil {
+		log.Debugf("Cannot set the window size of the pty: %v", err)
+	}
+}
+
+// make_ptys replaces the pipes at the even positions of pipes, which
+// carry the output of a stage with Options.Pty, with pseudo-terminals.
+// All of pipes is closed if that fails.
+func make_ptys(pipes [][2]int) error {
+	for i := 0; i < len(pipes); i += 2 {
+		pty, err := open_pty()
+		if err != nil {
+			for _, fds := range pipes {
+				syscall.Close(fds[0])
+				syscall.Close(fds[1])
+			}
+			return fmt.Errorf("cannot open a pty: %v", err)
+		}
+		syscall.Close(pipes[i][0])
+		syscall.Close(pipes[i][1])
+		pipes[i] = pty
+	}
+	return nil
+}
+
+// add_pty and remove_pty keep track of the pty masters in use, for
+// Resize.
+func (s *Supervisor) add_pty(master *os.File) {
+	s.ptys_mu.Lock()
+	defer s.ptys_mu.Unlock()
+	s.ptys[master] = true
+}
+
+func (s *Supervisor) remove_pty(master *os.File) {
+	s.ptys_mu.Lock()
+	defer s.ptys_mu.Unlock()
+	delete(s.ptys, master)
+}
+
+// Resize gives the pseudo-terminals of Options.Pty the window size of
+// our terminal again, e.g. on SIGWINCH.
+func (s *Supervisor) Resize() {
+	s.ptys_mu.Lock()
+	defer s.ptys_mu.Unlock()
+	for master := range s.ptys {
+		set_window_size(int(master.Fd()))
+	}
+}
@@ -0,0 +1,526 @@
+package supervisor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Pump copies the output of each stage of a linear pipeline to the
+// next one's stdin itself, instead of the two sharing a pipe, counting
+// the bytes and lines that go through. The stages restart together,
+// unless Options.IndependentRestart is set, but the last one can also be
+// replaced without a gap. With IndependentRestart and Options.Spill,
+// what a stage misses while it is down is kept on disk and replayed to
+// it first once it is back.
+type Pump struct {
+	sup *Supervisor
+	wg  sync.WaitGroup
+	ctx context.Context
+
+	// With Options.ZeroDowntime the last stage can be replaced while
+	// the pipeline runs, see replace.
+	mu   sync.Mutex
+	last *link
+	// Stops the current last stage.
+	stop_last context.CancelFunc
+	// The replacement of the last stage, not switched to yet.
+	pending      *os.File
+	pending_ctx  context.Context
+	stop_pending context.CancelFunc
+
+	// The stdin of every stage but the first, with Options.Spill.
+	inputs map[string]*link
+}
+
+// link is the stdin of the stage a copy writes to.
+type link struct {
+	mu     sync.Mutex
+	dst    *os.File
+	closed bool
+	// With Options.Spill, what the stage missed while it was down, until
+	// it has all been replayed, and the signal that some of it has been.
+	sp      *spill
+	drained *sync.Cond
+	// Set once the pipeline is being stopped, nothing will drain sp any
+	// more.
+	stopping bool
+}
+
+func (l *link) get() *os.File {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.dst
+}
+
+// swap makes dst the stdin to write to and returns the old one. If the
+// copy has already finished dst is closed straight away, so the stage
+// still gets EOF.
+func (l *link) swap(dst *os.File) *os.File {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	old := l.dst
+	l.dst = dst
+	if l.closed {
+		dst.Close()
+	}
+	return old
+}
+
+func (l *link) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	if l.sp == nil {
+		// Otherwise the replay closes it once it has caught up.
+		l.dst.Close()
+	}
+}
+
+// start_pumped starts a linear pipeline with a Pump between each pair
+// of stages.
+func (s *Supervisor) start_pumped(ctx context.Context, pipeline []Stage, comms chan ChildEvent) ([]int, Hub, error) {
+	// Between stage i and i+1, pipes[2*i] carries the output of stage i
+	// and pipes[2*i+1] the input of stage i+1.
+	pipes, err := s.make_data_pipes(2 * (len(pipeline) - 1))
+	if err != nil {
+		return nil, nil, err
+	}
+	if s.opts.Pty {
+		if err := make_ptys(pipes); err != nil {
+			return nil, nil, err
+		}
+	}
+	pump := &Pump{sup: s, ctx: ctx, inputs: make(map[string]*link)}
+	var child_fds, spilled_fds []int
+	stdio := make(map[string][2]int)
+	for i, stage := range pipeline {
+		infd, outfd := -1, -1
+		if i > 0 {
+			infd = pipes[2*i-1][0]
+			if s.opts.Spill {
+				// Not kept open, so that the copy sees the stage go
+				// down.
+				spilled_fds = append(spilled_fds, infd)
+			} else {
+				child_fds = append(child_fds, infd)
+			}
+		}
+		if i < len(pipeline)-1 {
+			outfd = pipes[2*i][1]
+			child_fds = append(child_fds, outfd)
+		}
+		stdio[stage.Role] = [2]int{infd, outfd}
+		if i == 0 {
+			go s.start_producer(ctx, stage, pipeline[len(pipeline)-1], -1, outfd, comms)
+			continue
+		}
+		stage_ctx := ctx
+		if i == len(pipeline)-1 {
+			// Its own context, so it can be stopped once replaced.
+			stage_ctx, pump.stop_last = context.WithCancel(ctx)
+		}
+		go s.watch_stage(stage_ctx, stage, infd, outfd, comms)
+	}
+	for i, stage := range pipeline[:len(pipeline)-1] {
+		src := os.NewFile(uintptr(pipes[2*i][0]), stage.Role+" stdout")
+		if s.opts.Pty {
+			s.add_pty(src)
+		}
+		l := &link{dst: os.NewFile(uintptr(pipes[2*i+1][1]), pipeline[i+1].Role+" stdin")}
+		if s.opts.Spill {
+			l.drained = sync.NewCond(&l.mu)
+			pump.inputs[pipeline[i+1].Role] = l
+		}
+		pump.last = l
+		pump.wg.Add(1)
+		var tee io.Writer
+		if i == 0 {
+			tee = s.opts.Tee
+		}
+		go pump.copy(stage.Role, pipeline[i+1].Role, src, l, tee)
+	}
+	if s.opts.IndependentRestart {
+		return spilled_fds, &Pipes{sup: s, stdio: stdio, fds: child_fds, inner: pump}, nil
+	}
+	return child_fds, pump, nil
+}
+
+// copy moves data from src, the stdout of role, to l, the stdin of
+// next, until src hits EOF, then closes l so next sees EOF too. If next
+// stops reading, src is closed and role gets EPIPE. The data also goes
+// to tee, if not nil.
+func (p *Pump) copy(role string, next string, src *os.File, l *link, tee io.Writer) {
+	defer p.wg.Done()
+	defer src.Close()
+	defer p.sup.remove_pty(src)
+	defer l.close()
+	size := p.sup.opts.PumpBuffer
+	if size <= 0 {
+		size = 32 * 1024
+	}
+	var w writer
+	if p.sup.opts.StallTimeout > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go p.watch_stall(next, &w, done)
+	}
+	// Whether the last write to tee failed, to only log the first of a
+	// run of failures.
+	tee_failing := false
+	buf := make([]byte, size)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if err := p.send(next, &w, l, buf[:n]); err != nil {
+				log.Debugf("%s stopped reading: %v", next, err)
+				return
+			}
+			if tee != nil {
+				if _, err := tee.Write(buf[:n]); err != nil {
+					if !tee_failing {
+						log.Warningf("Cannot tee the output of %s: %v", role, err)
+					}
+					tee_failing = true
+				} else if tee_failing {
+					log.Infof("Teeing the output of %s again", role)
+					tee_failing = false
+				}
+			}
+			p.sup.metrics.Pumped(role, n, bytes.Count(buf[:n], []byte{'\n'}))
+		}
+		if err != nil {
+			// A pty master reads EIO rather than EOF once the slave
+			// is closed.
+			if err != io.EOF && !(p.sup.opts.Pty && errors.Is(err, syscall.EIO)) {
+				log.Errorf("Reading from %s failed: %v", role, err)
+			}
+			return
+		}
+	}
+}
+
+// writer tracks the writes to a stage's stdin for the stall detector.
+type writer struct {
+	// Whether a write is under way, and when it started.
+	busy  atomic.Bool
+	since atomic.Int64
+}
+
+// write writes data to l. If the stage behind l is replaced half way,
+// the rest goes to its replacement.
+func (w *writer) write(l *link, data []byte) error {
+	for {
+		dst := l.get()
+		n, err := w.write_to(dst, data)
+		if err == nil || l.get() == dst {
+			return err
+		}
+		data = data[n:]
+	}
+}
+
+func (w *writer) write_to(dst *os.File, data []byte) (int, error) {
+	w.since.Store(time.Now().UnixNano())
+	w.busy.Store(true)
+	defer w.busy.Store(false)
+	return dst.Write(data)
+}
+
+// stalled says how long the current write has been blocked, 0 if there
+// is none.
+func (w *writer) stalled() time.Duration {
+	if !w.busy.Load() {
+		return 0
+	}
+	return time.Since(time.Unix(0, w.since.Load()))
+}
+
+// watch_stall checks every so often whether role has stopped reading
+// from its stdin, that is whether a write to it has been blocked for
+// longer than Options.StallTimeout. An idle producer is not a stall. A
+// stalled role is logged, and with Options.StallRestart stopped, the stop
+// signal then SIGKILL after Options.StopTimeout, which restarts the pipeline
+// under the usual policy.
+func (p *Pump) watch_stall(role string, w *writer, done chan struct{}) {
+	opts := &p.sup.opts
+	ticker := time.NewTicker(max(opts.StallTimeout/4, 10*time.Millisecond))
+	defer ticker.Stop()
+	// When the current stall was reported, and when role was sent the
+	// stop signal for it.
+	var reported, termed time.Time
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		stalled := w.stalled()
+		if stalled <= opts.StallTimeout {
+			reported, termed = time.Time{}, time.Time{}
+			continue
+		}
+		if reported.IsZero() {
+			reported = time.Now()
+			log.Warning(WithFields(fmt.Sprintf("%s has not read its stdin for %v", role, stalled.Round(time.Millisecond)),
+				Fields{"role": role, "stalled_seconds": stalled.Seconds()}))
+			p.sup.metrics.Stalled(role)
+		}
+		if !opts.StallRestart {
+			continue
+		}
+		pid := p.sup.child_pid(role)
+		if pid == 0 {
+			continue
+		}
+		if termed.IsZero() {
+			log.Warningf("Stopping %s (PID %d) for stalling", role, pid)
+			p.sup.kill(pid, opts.StopSignal)
+			termed = time.Now()
+		} else if time.Since(termed) > opts.StopTimeout {
+			log.Warningf("%s (PID %d) didn't exit after %s, sending SIGKILL", role, pid, unix.SignalName(opts.StopSignal))
+			p.sup.kill(pid, syscall.SIGKILL)
+			termed = time.Now()
+		}
+	}
+}
+
+// Respawn is never called, the stages of a linear pipeline restart
+// together.
+func (p *Pump) Respawn(ctx context.Context, stage Stage, comms chan ChildEvent) (int, error) {
+	return -1, fmt.Errorf("%s can't be restarted on its own", stage.Role)
+}
+
+// Wait blocks until every copy has finished, and drops the spills.
+func (p *Pump) Wait() {
+	for _, l := range p.inputs {
+		l.mu.Lock()
+		l.stopping = true
+		l.drained.Broadcast()
+		l.mu.Unlock()
+	}
+	p.wg.Wait()
+	p.abandon()
+	for _, l := range p.inputs {
+		l.mu.Lock()
+		if l.sp != nil {
+			l.sp.close()
+			l.sp = nil
+			l.dst.Close()
+		}
+		l.mu.Unlock()
+	}
+}
+
+// replace starts a replacement for stage, the last of the pipeline,
+// alongside it. Nothing is sent to the replacement until switch_over.
+// It returns the child's end of its pipe, like Respawn.
+func (p *Pump) replace(stage Stage, comms chan ChildEvent) (int, error) {
+	pipes, err := p.sup.make_data_pipes(1)
+	if err != nil {
+		return -1, err
+	}
+	ctx, cancel := context.WithCancel(p.ctx)
+	p.mu.Lock()
+	p.pending = os.NewFile(uintptr(pipes[0][1]), stage.Role+" stdin")
+	p.pending_ctx = ctx
+	p.stop_pending = cancel
+	p.mu.Unlock()
+	go p.sup.watch_stage(ctx, stage, pipes[0][0], -1, comms)
+	return pipes[0][0], nil
+}
+
+// replacement_ready waits for the replacement of stage to be ready, by
+// Options.ReadyCommand if there is one.
+func (p *Pump) replacement_ready(stage Stage) error {
+	if len(p.sup.opts.ReadyCommand) == 0 {
+		return nil
+	}
+	p.mu.Lock()
+	ctx := p.pending_ctx
+	p.mu.Unlock()
+	return p.sup.wait_ready(ctx, stage)
+}
+
+// switch_over sends the data to the replacement from now on, and stops
+// the stage it replaces: its stdin is closed and it is terminated.
+func (p *Pump) switch_over() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	old := p.last.swap(p.pending)
+	p.stop_last()
+	p.stop_last = p.stop_pending
+	p.pending, p.pending_ctx, p.stop_pending = nil, nil, nil
+	old.Close()
+}
+
+// abandon stops the replacement, if there is one.
+func (p *Pump) abandon() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.pending == nil {
+		return
+	}
+	p.stop_pending()
+	p.pending.Close()
+	p.pending, p.pending_ctx, p.stop_pending = nil, nil, nil
+}
+
+// send writes data to l, the stdin of role. With Options.Spill, once a
+// write fails because role is down, data goes to its spill instead,
+// until it is back and has caught up.
+func (p *Pump) send(role string, w *writer, l *link, data []byte) error {
+	if l.drained == nil {
+		return w.write(l, data)
+	}
+	for {
+		l.mu.Lock()
+		if l.sp != nil {
+			spilled := p.spill(role, l, data)
+			l.mu.Unlock()
+			if spilled {
+				return nil
+			}
+			continue
+		}
+		dst := l.dst
+		l.mu.Unlock()
+		n, err := w.write_to(dst, data)
+		if err == nil {
+			return nil
+		}
+		data = data[n:]
+		l.mu.Lock()
+		if l.dst == dst && l.sp == nil {
+			log.Debugf("%s stopped reading: %v", role, err)
+			err = p.detach(role, l)
+		} else {
+			// Restarted meanwhile, the rest goes to the new one.
+			err = nil
+		}
+		l.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// detach closes the stdin of role, which is down, and starts a spill for
+// it. Called with l.mu held.
+func (p *Pump) detach(role string, l *link) error {
+	l.dst.Close()
+	sp, err := new_spill(role, p.sup.opts.SpillMax)
+	if err != nil {
+		return fmt.Errorf("cannot spill the data for %s: %v", role, err)
+	}
+	log.Infof("%s is down, spilling its data to disk", role)
+	l.sp = sp
+	return nil
+}
+
+// spill adds data to the spill of l, or waits for room with
+// Options.SpillBlock. It returns false if the spill has been replayed
+// meanwhile, data then goes to role straight away. Called with l.mu
+// held.
+func (p *Pump) spill(role string, l *link, data []byte) bool {
+	sp := l.sp
+	if p.sup.opts.SpillBlock {
+		for int64(len(data)) > sp.room() && !l.stopping && l.sp == sp {
+			if !sp.full {
+				sp.full = true
+				log.Warningf("The spill buffer of %s is full, holding back what it reads from", role)
+			}
+			l.drained.Wait()
+		}
+		if l.sp != sp {
+			return false
+		}
+	} else if int64(len(data)) > sp.room() && !sp.full {
+		sp.full = true
+		log.Warningf("The spill buffer of %s is full, dropping the oldest data", role)
+	}
+	if err := sp.write(data); err != nil {
+		log.Errorf("Cannot spill the data for %s, it will miss it: %v", role, err)
+		l.sp = nil
+		sp.close()
+	}
+	return true
+}
+
+// respawn starts stage again on a new stdin, for Pipes with
+// Options.Spill, replaying what it missed to it first. It returns the
+// child's end of the pipe like Respawn.
+func (p *Pump) respawn(ctx context.Context, stage Stage, outfd int, comms chan ChildEvent) (int, error) {
+	pipes, err := p.sup.make_data_pipes(1)
+	if err != nil {
+		return -1, err
+	}
+	l := p.inputs[stage.Role]
+	dst := os.NewFile(uintptr(pipes[0][1]), stage.Role+" stdin")
+	l.mu.Lock()
+	l.dst.Close()
+	l.dst = dst
+	if l.sp != nil {
+		go p.replay(stage.Role, l, l.sp, dst)
+	} else if l.closed {
+		dst.Close()
+	}
+	l.mu.Unlock()
+	go p.sup.watch_stage(ctx, stage, pipes[0][0], outfd, comms)
+	return pipes[0][0], nil
+}
+
+// replay copies the spill sp of l to w, the stdin of role, after which
+// the copy writes to w itself.
+func (p *Pump) replay(role string, l *link, sp *spill, w *os.File) {
+	l.mu.Lock()
+	log.Infof("Replaying %d bytes to %s", sp.len(), role)
+	l.mu.Unlock()
+	buf := make([]byte, 32*1024)
+	for {
+		l.mu.Lock()
+		if l.dst != w || l.sp != sp {
+			// Restarted again, or stopped, since.
+			l.mu.Unlock()
+			return
+		}
+		from := sp.roff
+		n, err := sp.peek(buf)
+		if err != nil {
+			log.Errorf("Cannot read the spilled data for %s, it will miss it: %v", role, err)
+			n = 0
+		}
+		if n == 0 {
+			// Caught up, new data goes straight to w from here on.
+			l.sp = nil
+			sp.close()
+			l.drained.Broadcast()
+			if l.closed {
+				w.Close()
+			}
+			l.mu.Unlock()
+			log.Infof("%s has caught up", role)
+			return
+		}
+		l.mu.Unlock()
+		written, err := w.Write(buf[:n])
+		l.mu.Lock()
+		sp.discard(from, written)
+		l.drained.Broadcast()
+		l.mu.Unlock()
+		if err != nil {
+			// Down again, the rest stays spilled for the next one.
+			log.Debugf("%s stopped reading: %v", role, err)
+			return
+		}
+	}
+}
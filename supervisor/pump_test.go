@@ -0,0 +1,72 @@
+package supervisor_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/msoulier/mrun/supervisor"
+)
+
+func TestPumpSpill(t *testing.T) {
+	const lines = 100000
+	dir := t.TempDir()
+	sh := look_path(t, "sh")
+	look_path(t, "seq")
+	out := filepath.Join(dir, "out")
+	s, err := supervisor.New(supervisor.Options{
+		Stages: []supervisor.Stage{
+			// More than a pipe holds, so without the spill it would
+			// still be writing when the consumer is back.
+			{Role: "producer", Path: sh, Args: []string{"-c", fmt.Sprintf("sleep 0.2; seq %d; touch %s/produced; sleep 30", lines, dir)}},
+			// Down for the first second, then records whether the
+			// producer got it all out meanwhile.
+			{Role: "consumer", Path: sh, Args: []string{"-c", fmt.Sprintf(`cd %s
+if [ ! -e started ]; then touch started; exit 1; fi
+if [ -e produced ]; then touch spilled; fi
+exec cat >> out`, dir)}},
+		},
+		Pump:               true,
+		IndependentRestart: true,
+		Spill:              true,
+		SpillMax:           64 << 20,
+		BackoffBase:        time.Second,
+		MinHealthy:         time.Minute,
+		StopTimeout:        time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want bytes.Buffer
+	for i := 1; i <= lines; i++ {
+		fmt.Fprintln(&want, i)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- s.Run(ctx) }()
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		got, _ := os.ReadFile(out)
+		if len(got) >= want.Len() || ctx.Err() != nil {
+			break
+		}
+		<-ticker.C
+	}
+	s.Stop()
+	if err := <-done; err != nil {
+		t.Fatalf("Run returned %v", err)
+	}
+	got, _ := os.ReadFile(out)
+	if !bytes.Equal(got, want.Bytes()) {
+		t.Fatalf("the consumer got %d bytes, not the %d of the producer", len(got), want.Len())
+	}
+	if _, err := os.Stat(filepath.Join(dir, "spilled")); err != nil {
+		t.Error("the producer was held back while the consumer was down")
+	}
+}
@@ -0,0 +1,74 @@
+package supervisor
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RateLimit is a sliding window restart budget, e.g. at most 5 restarts
+// in any 60 second window.
+type RateLimit struct {
+	Max    int
+	Window time.Duration
+	stamps []time.Time
+}
+
+// ParseRate parses a rate of the form "N/duration", e.g. "5/60s".
+func ParseRate(spec string) (RateLimit, error) {
+	count, window, found := strings.Cut(spec, "/")
+	if !found {
+		return RateLimit{}, fmt.Errorf("bad restart rate %q, expected N/duration", spec)
+	}
+	max, err := strconv.Atoi(count)
+	if err != nil || max < 1 {
+		return RateLimit{}, fmt.Errorf("bad restart count in %q", spec)
+	}
+	d, err := time.ParseDuration(window)
+	if err != nil || d <= 0 {
+		return RateLimit{}, fmt.Errorf("bad restart window in %q", spec)
+	}
+	return RateLimit{Max: max, Window: d}, nil
+}
+
+// expire drops timestamps that have fallen out of the window.
+func (r *RateLimit) expire(now time.Time) {
+	i := 0
+	for i < len(r.stamps) && now.Sub(r.stamps[i]) >= r.Window {
+		i++
+	}
+	r.stamps = r.stamps[i:]
+}
+
+// Delay returns how long to wait before another restart fits in the
+// window, or 0 if one is allowed now.
+func (r *RateLimit) Delay(now time.Time) time.Duration {
+	r.expire(now)
+	if len(r.stamps) < r.Max {
+		return 0
+	}
+	return r.stamps[0].Add(r.Window).Sub(now)
+}
+
+// Record notes that a restart happened at now.
+func (r *RateLimit) Record(now time.Time) {
+	r.expire(now)
+	r.stamps = append(r.stamps, now)
+}
+
+// Exceeded reports whether more than Max restarts have been recorded in
+// the window up to now.
+func (r *RateLimit) Exceeded(now time.Time) bool {
+	r.expire(now)
+	return len(r.stamps) > r.Max
+}
+
+// Reset forgets the restarts recorded so far.
+func (r *RateLimit) Reset() {
+	r.stamps = nil
+}
+
+func (r RateLimit) String() string {
+	return fmt.Sprintf("%d/%v", r.Max, r.Window)
+}
@@ -0,0 +1,60 @@
+package supervisor
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// How often Options.ReadyCommand is run while the consumer isn't ready.
+const ready_poll_interval = 250 * time.Millisecond
+
+// start_producer starts stage, the first of a linear pipeline, like
+// watch_stage does, but only once the last stage is ready if
+// Options.ReadyCommand is set. If it never gets ready the producer's
+// start event carries the error.
+func (s *Supervisor) start_producer(ctx context.Context, stage Stage, consumer Stage, infd int, outfd int, comms chan ChildEvent) {
+	if len(s.opts.ReadyCommand) > 0 {
+		if err := s.wait_ready(ctx, consumer); err != nil {
+			comms <- ChildEvent{Role: stage.Role, Err: err}
+			return
+		}
+	}
+	s.watch_stage(ctx, stage, infd, outfd, comms)
+}
+
+// wait_ready runs Options.ReadyCommand until it exits 0, at most for
+// Options.ReadyTimeout. It runs with the environment, working directory
+// and credentials of consumer.
+func (s *Supervisor) wait_ready(ctx context.Context, consumer Stage) error {
+	parent := ctx
+	if s.opts.ReadyTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.opts.ReadyTimeout)
+		defer cancel()
+	}
+	log.Infof("Waiting for %s to be ready", consumer.Role)
+	start := time.Now()
+	for {
+		cmd := exec.CommandContext(ctx, s.opts.ReadyCommand[0], s.opts.ReadyCommand[1:]...)
+		cmd.Env = s.opts.Env
+		cmd.Dir = consumer.Dir
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: s.opts.Credentials.credential()}
+		out, err := cmd.CombinedOutput()
+		if err == nil {
+			log.Infof("%s is ready after %v", consumer.Role, time.Since(start).Round(time.Millisecond))
+			return nil
+		}
+		log.Debugf("%s not ready: %v %s", consumer.Role, err, out)
+		select {
+		case <-ctx.Done():
+			if parent.Err() != nil {
+				return parent.Err()
+			}
+			return fmt.Errorf("%s not ready after %v", consumer.Role, s.opts.ReadyTimeout)
+		case <-time.After(ready_poll_interval):
+		}
+	}
+}
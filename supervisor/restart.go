@@ -0,0 +1,92 @@
+package supervisor
+
+import "time"
+
+// restarter is what the restart decisions of Run carry over from one run
+// of the pipeline to the next.
+type restarter struct {
+	backoff  time.Duration
+	failures int
+	// Since when the restart rate has been exceeded, zero while it
+	// isn't.
+	saturated_since time.Time
+}
+
+// restart_plan is what follows a run of the pipeline, see decide_restart.
+type restart_plan struct {
+	// Run returns without an error instead of restarting.
+	stop bool
+	// How long to wait for the restart rate, then for delay.
+	rate_wait time.Duration
+	delay     time.Duration
+}
+
+// decide_restart works out at now what follows exits, those of the
+// stages that ended a run of the pipeline under opts by themselves: an
+// error or a stop for Run to return, or a restart after a delay. Only a
+// restart updates the backoff, the restart rate and the flap count.
+func (s *Supervisor) decide_restart(opts *Options, r *restarter, exits []ChildEvent, now time.Time) (restart_plan, error) {
+	// The decision, and the blame, go to the first stage that failed.
+	ev := first_failure(exits)
+	if opts.RestartOnFailure && succeeded(ev) {
+		// Every stage did.
+		log.Infof("%s exited successfully, shutting down", ev.Role)
+		return restart_plan{stop: true}, nil
+	}
+	if opts.policy(ev.Role) != Restart {
+		if succeeded(ev) {
+			return restart_plan{stop: true}, nil
+		}
+		return restart_plan{}, &ExitError{Role: ev.Role, Index: stage_index(opts.Stages, ev.Role), Status: ev.Status}
+	}
+
+	// A stage that stayed up long enough resets the backoff and the
+	// failure count.
+	if ev.Ran >= opts.MinHealthy {
+		r.backoff = opts.BackoffBase
+		r.failures = 0
+	}
+	r.failures++
+	if opts.MaxRestarts > 0 && r.failures > opts.MaxRestarts {
+		log.Errorf("%s failed %d times in a row, giving up", ev.Role, r.failures)
+		return restart_plan{}, ErrMaxRestarts
+	}
+	var plan restart_plan
+	if s.restart_rate.Max > 0 {
+		if wait := s.restart_rate.Delay(now); wait > 0 {
+			if r.saturated_since.IsZero() {
+				r.saturated_since = now
+			}
+			if now.Sub(r.saturated_since) > opts.RestartRateGrace {
+				log.Errorf("restart rate %v exceeded for over %v, giving up", s.restart_rate, opts.RestartRateGrace)
+				return restart_plan{}, ErrRateLimited
+			}
+			log.Warningf("restart rate %v exceeded, waiting %v", s.restart_rate, wait)
+			plan.rate_wait = wait
+		} else {
+			r.saturated_since = time.Time{}
+		}
+		s.restart_rate.Record(now.Add(plan.rate_wait))
+	}
+	plan.delay = s.flap_delay(opts.RestartDelay+r.backoff, now.Add(plan.rate_wait))
+	r.backoff = s.next_backoff(r.backoff)
+	return plan, nil
+}
+
+// first_failure returns the first of exits that failed, or the first of
+// them if none did.
+func first_failure(exits []ChildEvent) ChildEvent {
+	for _, ev := range exits {
+		if !succeeded(ev) {
+			return ev
+		}
+	}
+	return exits[0]
+}
+
+// restarted counts a restart of role, once it has been decided on, in
+// the metrics and in restarts, the counts of the status.
+func (s *Supervisor) restarted(role string, restarts map[string]uint64) {
+	s.metrics.Restarted(role)
+	restarts[role]++
+}
@@ -0,0 +1,170 @@
+package supervisor_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/msoulier/mrun/supervisor"
+	"github.com/msoulier/mrun/supervisor/supervisortest"
+)
+
+// fake_options returns the options of a producer and consumer started
+// by l.
+func fake_options(l *supervisortest.Launcher) supervisor.Options {
+	return supervisor.Options{
+		Stages: []supervisor.Stage{
+			{Role: "producer", Path: "/bin/true"},
+			{Role: "consumer", Path: "/bin/cat"},
+		},
+		Launcher:    l,
+		BackoffBase: 10 * time.Millisecond,
+		BackoffMax:  40 * time.Millisecond,
+		MinHealthy:  time.Minute,
+		StopTimeout: time.Second,
+	}
+}
+
+// fail_producer has every producer l starts exit 1 as soon as it has
+// started, until ctx is done.
+func fail_producer(ctx context.Context, l *supervisortest.Launcher) {
+	for {
+		select {
+		case p := <-l.Started():
+			if p.Spec.Role == "producer" {
+				p.Exit(1)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// run_fake runs s with a producer that keeps failing, and returns what
+// Run returned and the delays of the restarts, in order.
+func run_fake(t *testing.T, s *supervisor.Supervisor, l *supervisortest.Launcher, restarts int) (error, []time.Duration) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	go fail_producer(ctx, l)
+	var delays []time.Duration
+	events := make(chan struct{})
+	go func() {
+		defer close(events)
+		for ev := range s.Events() {
+			if ev.Type != supervisor.EventRestarting {
+				continue
+			}
+			delays = append(delays, time.Duration(ev.DelaySeconds*float64(time.Second)).Round(time.Millisecond))
+			if len(delays) == restarts {
+				s.Stop()
+			}
+		}
+	}()
+	err := s.Run(ctx)
+	<-events
+	if ctx.Err() != nil {
+		t.Fatal("the run didn't end")
+	}
+	return err, delays
+}
+
+func TestBackoff(t *testing.T) {
+	l := supervisortest.NewLauncher(16)
+	s, err := supervisor.New(fake_options(l))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err, delays := run_fake(t, s, l, 5)
+	if err != nil {
+		t.Fatalf("Run returned %v", err)
+	}
+	want := []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond, 40 * time.Millisecond, 40 * time.Millisecond}
+	if len(delays) != len(want) {
+		t.Fatalf("got delays %v, want %v", delays, want)
+	}
+	for i := range want {
+		if delays[i] != want[i] {
+			t.Errorf("got delays %v, want %v", delays, want)
+			break
+		}
+	}
+}
+
+func TestMaxRestarts(t *testing.T) {
+	l := supervisortest.NewLauncher(16)
+	opts := fake_options(l)
+	opts.MaxRestarts = 2
+	s, err := supervisor.New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err, delays := run_fake(t, s, l, -1)
+	// mrun exits with ExitMaxRestarts on it.
+	if !errors.Is(err, supervisor.ErrMaxRestarts) {
+		t.Fatalf("Run returned %v, want ErrMaxRestarts", err)
+	}
+	if len(delays) != 2 {
+		t.Errorf("restarted %d times, want 2", len(delays))
+	}
+	restarts, _ := s.Metrics().Totals()
+	if restarts["producer"] != 2 || restarts["consumer"] != 0 {
+		t.Errorf("counted restarts %v, want 2 of the producer", restarts)
+	}
+	if started := len(l.Children()); started != 6 {
+		t.Errorf("started %d children, want 6", started)
+	}
+}
+
+func TestOnceCountsNoRestarts(t *testing.T) {
+	l := supervisortest.NewLauncher(16)
+	opts := fake_options(l)
+	opts.Policy = supervisor.Once
+	s, err := supervisor.New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	go func() {
+		for range 2 {
+			(<-l.Started()).Exit(0)
+		}
+	}()
+	if err := s.Run(ctx); err != nil {
+		t.Fatalf("Run returned %v", err)
+	}
+	restarts, _ := s.Metrics().Totals()
+	for role, count := range restarts {
+		if count != 0 {
+			t.Errorf("counted %d restarts of %s, want none", count, role)
+		}
+	}
+}
+
+func TestFlapCooldown(t *testing.T) {
+	l := supervisortest.NewLauncher(16)
+	opts := fake_options(l)
+	opts.BackoffBase = 0
+	opts.FlapThreshold = 2
+	opts.FlapWindow = time.Minute
+	opts.FlapCooldown = 50 * time.Millisecond
+	s, err := supervisor.New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err, delays := run_fake(t, s, l, 6)
+	if err != nil {
+		t.Fatalf("Run returned %v", err)
+	}
+	// The third restart within the window is one too many, and the
+	// count starts over after the cooldown.
+	cooldown := opts.FlapCooldown
+	want := []time.Duration{0, 0, cooldown, 0, 0, cooldown}
+	for i := range want {
+		if i >= len(delays) || delays[i] != want[i] {
+			t.Fatalf("got delays %v, want %v", delays, want)
+		}
+	}
+}
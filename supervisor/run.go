@@ -0,0 +1,610 @@
+package supervisor
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Run starts the pipeline and keeps it running according to the
+// options, until Stop is called, ctx is cancelled or the policy says to
+// give up. It returns nil after a requested stop or a clean exit,
+// ErrMaxRestarts or ErrRateLimited when it gives up, an *ExitError when a
+// stage fails under NoRestart or Once, and any other error if the pipeline
+// could not be started. Options.PreStart runs first and Options.PostStop
+// last, once each. Run is only meant to be called once.
+func (s *Supervisor) Run(ctx context.Context) error {
+	err := s.run(ctx)
+	ev := Event{Type: EventStopped}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	s.emit(ev)
+	s.close_events()
+	return err
+}
+
+// run is Run, without the stopped event.
+func (s *Supervisor) run(ctx context.Context) error {
+	// Stop cancels the same way as ctx does, so there is only one thing
+	// to watch from here on.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer s.remove_pids_file()
+	if s.opts.Cgroup != "" {
+		s.cgroup = s.setup_cgroup()
+		if s.cgroup != nil {
+			defer s.cgroup.remove()
+		}
+	}
+	if s.opts.Stdin != nil || s.opts.Stdout != nil {
+		if err := s.open_stdio(); err != nil {
+			return err
+		}
+		defer s.std.close(s.opts.StopTimeout)
+	}
+	if s.opts.TCPAddr != "" {
+		bridge, err := s.open_bridge()
+		if err != nil {
+			return err
+		}
+		s.bridge = bridge
+		defer bridge.close()
+	}
+	if s.opts.FIFO != "" {
+		created, err := s.make_fifo()
+		if err != nil {
+			return err
+		}
+		s.fifo = s.opts.FIFO
+		defer s.remove_fifo(created)
+	}
+	if len(s.opts.PreStart) > 0 {
+		if err := s.run_hook(ctx, "pre-start", s.opts.PreStart); err != nil {
+			return err
+		}
+	}
+	defer s.post_stop()
+	go func() {
+		select {
+		case <-s.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	start_time := time.Now()
+	restarts := make(map[string]uint64)
+	for _, stage := range s.opts.Stages {
+		restarts[stage.Role] = 0
+	}
+	r := restarter{backoff: s.opts.BackoffBase}
+	for {
+		if ctx.Err() != nil {
+			break
+		}
+		s.mu.Lock()
+		if s.next != nil {
+			if err := s.apply(*s.next); err != nil {
+				log.Errorf("Ignoring the new options: %v", err)
+			}
+			s.next = nil
+		}
+		s.mu.Unlock()
+		opts := s.opts
+		started := time.Now()
+		comms := make(chan ChildEvent)
+		pipeline := opts.Stages
+		log.Debug("Run: top of for loop")
+		// Cancelled to stop this run's children.
+		run_ctx, stop_run := context.WithCancel(ctx)
+		// Unless there is a drain: then a shutdown only stops them
+		// straight away while they are being started.
+		stop_startup := func() bool { return false }
+		if opts.DrainTimeout > 0 {
+			run_ctx, stop_run = context.WithCancel(context.WithoutCancel(ctx))
+			stop_startup = context.AfterFunc(ctx, stop_run)
+		}
+		pipefds, hub, err := s.start_pipeline(run_ctx, pipeline, comms)
+		if err != nil {
+			stop_run()
+			return fmt.Errorf("cannot create pipe: %v", err)
+		}
+
+		// Wait for every stage to have forked. A stage can exit before
+		// the others have even started, so hold on to any early exit.
+		running := make(map[string]uintptr)
+		var early []ChildEvent
+		var fork_err error
+		for forked := 0; forked < len(pipeline); {
+			e := <-comms
+			if e.Exited {
+				delete(running, e.Role)
+				early = append(early, e)
+				continue
+			}
+			forked++
+			if e.Err != nil {
+				fork_err = e.Err
+				continue
+			}
+			log.Debugf("%s forked as PID %d", e.Role, e.Pid)
+			running[e.Role] = e.Pid
+			s.metrics.SetPid(e.Role, e.Pid)
+		}
+		stop_startup()
+		// In a fan-out or fan-in pipeline the stages on the far side of
+		// the hub restart on their own, each with its own backoff. The
+		// hub stage is the single producer or consumer. With
+		// IndependentRestart every stage of a linear pipeline does.
+		hub_role := ""
+		switch opts.Topology {
+		case FanOut:
+			hub_role = pipeline[0].Role
+		case FanIn:
+			hub_role = pipeline[len(pipeline)-1].Role
+		}
+		stage_backoff := make(map[string]time.Duration)
+		stage_failures := make(map[string]int)
+		// The exit of each stage waiting to be respawned, until it is.
+		stage_exits := make(map[string]ChildEvent)
+		stage_fds := make(map[string]int)
+		respawn := make(chan string, len(pipeline))
+		// Under ZeroDowntime, the replacement under way and the children
+		// that have been replaced but not yet exited, by PID.
+		var zdd *replacement
+		retiring := make(map[uintptr]string)
+		for _, stage := range pipeline {
+			stage_backoff[stage.Role] = opts.BackoffBase
+		}
+		// Set when Run has to return rather than restart.
+		var run_err error
+		if ctx.Err() == nil {
+			// A stop during startup is not a failure to start.
+			run_err = fork_err
+		}
+		s.track_children(running)
+
+		// Parent: close all pipe ends, but not until every child has
+		// forked. The loop above has counted a start event, sent after
+		// ForkExec returned, from every stage, so none of them can still
+		// need these fds.
+		for _, fd := range pipefds {
+			syscall.Close(fd)
+		}
+
+		// Block on either goroutine quitting, or a shutdown request.
+		var ev ChildEvent
+		forced_restart := false
+		// Under Once the run ends when the last stage exits, with the
+		// first failure if there was one.
+		var failed *ChildEvent
+		once_exit := func(e ChildEvent) {
+			if !succeeded(e) && failed == nil {
+				failed = &e
+			}
+		}
+		if opts.Policy == Once {
+			for _, e := range early {
+				log_exit(e)
+				once_exit(e)
+			}
+			early = nil
+		}
+		// The exits of the stages that ended the run by themselves, in
+		// the order they came in.
+		var exits []ChildEvent
+		if len(early) > 0 {
+			ev = early[0]
+			for _, e := range early {
+				log_exit(e)
+			}
+			exits = early
+		}
+	wait:
+		for len(early) == 0 && run_err == nil && (len(running) > 0 || len(stage_exits) > 0 || len(stage_fds) > 0) {
+			select {
+			case ev = <-comms:
+				if zdd != nil && zdd.pid == 0 && !ev.Exited && ev.Role == zdd.stage.Role {
+					syscall.Close(zdd.fd)
+					if ev.Err != nil {
+						log.Errorf("Cannot replace %s, keeping PID %d: %v", ev.Role, zdd.old, ev.Err)
+						zdd.pump.abandon()
+						zdd = nil
+						continue
+					}
+					log.Infof("%s replacement forked as PID %d", ev.Role, ev.Pid)
+					zdd.pid = ev.Pid
+					zdd.check_ready()
+					continue
+				}
+				if role, ok := retiring[ev.Pid]; ok && ev.Exited {
+					delete(retiring, ev.Pid)
+					log.Info(WithFields(fmt.Sprintf("Retired %s (PID %d) %s", role, ev.Pid, describe_status(ev.Status)),
+						Fields{"role": role, "pid": ev.Pid, "exit_status": ev.Status.ExitStatus()}))
+					continue
+				}
+				if zdd != nil && ev.Exited && ev.Pid == zdd.pid {
+					log.Errorf("The replacement of %s (PID %d) %s before it was ready, keeping PID %d",
+						ev.Role, ev.Pid, describe_status(ev.Status), zdd.old)
+					zdd.pump.abandon()
+					zdd = nil
+					continue
+				}
+				if ev.Err != nil {
+					// A respawn failed to fork.
+					syscall.Close(stage_fds[ev.Role])
+					delete(stage_fds, ev.Role)
+					run_err = ev.Err
+					break wait
+				}
+				if !ev.Exited {
+					// A stage has been respawned on its own.
+					log.Debugf("%s forked as PID %d", ev.Role, ev.Pid)
+					running[ev.Role] = ev.Pid
+					s.metrics.SetPid(ev.Role, ev.Pid)
+					s.track_children(running)
+					syscall.Close(stage_fds[ev.Role])
+					delete(stage_fds, ev.Role)
+					continue
+				}
+				delete(running, ev.Role)
+				if ev.Requested {
+					// Stopped for RestartStage, back straight away.
+					s.metrics.SetPid(ev.Role, 0)
+					s.track_children(running)
+					if ctx.Err() != nil || s.draining.Load() {
+						continue
+					}
+					log.Infof("restarting %s", ev.Role)
+					s.emit(Event{Type: EventRestarting, Role: ev.Role})
+					stage_exits[ev.Role] = ev
+					respawn <- ev.Role
+					continue
+				}
+				log_exit(ev)
+				if opts.Policy == Once {
+					once_exit(ev)
+					if len(running) > 0 {
+						continue
+					}
+					break wait
+				}
+				clean_exit := opts.RestartOnFailure && succeeded(ev)
+				if (opts.Topology == Linear && !opts.IndependentRestart) || ev.Role == hub_role || ctx.Err() != nil || s.draining.Load() || opts.policy(ev.Role) != Restart || clean_exit {
+					exits = append(exits, ev)
+					break wait
+				}
+				// Restart just this stage, the rest of the pipeline
+				// keeps running.
+				s.metrics.SetPid(ev.Role, 0)
+				s.track_children(running)
+				if ev.Ran >= opts.MinHealthy {
+					stage_backoff[ev.Role] = opts.BackoffBase
+					stage_failures[ev.Role] = 0
+				}
+				stage_failures[ev.Role]++
+				if opts.MaxRestarts > 0 && stage_failures[ev.Role] > opts.MaxRestarts {
+					log.Errorf("%s failed %d times in a row, giving up", ev.Role, stage_failures[ev.Role])
+					run_err = ErrMaxRestarts
+					break wait
+				}
+				delay := s.flap_delay(opts.RestartDelay+stage_backoff[ev.Role], time.Now())
+				stage_backoff[ev.Role] = s.next_backoff(stage_backoff[ev.Role])
+				log.Infof("restarting %s in %v", ev.Role, delay)
+				s.restarted(ev.Role, restarts)
+				s.emit(Event{Type: EventRestarting, Role: ev.Role, DelaySeconds: delay.Seconds()})
+				role := ev.Role
+				stage_exits[role] = ev
+				time.AfterFunc(delay, func() { respawn <- role })
+			case role := <-respawn:
+				if ctx.Err() != nil {
+					continue
+				}
+				if err := s.on_restart(ctx, stage_exits[role]); err != nil {
+					run_err = err
+					break wait
+				}
+				delete(stage_exits, role)
+				for _, stage := range pipeline {
+					if stage.Role != role {
+						continue
+					}
+					fd, err := hub.Respawn(run_ctx, stage, comms)
+					if err != nil {
+						run_err = fmt.Errorf("cannot restart %s: %v", role, err)
+						break wait
+					}
+					// Its start event can't have been received yet, we
+					// are the only reader of comms, so the fd is
+					// recorded before the event that closes it.
+					stage_fds[role] = fd
+				}
+			case err := <-zdd.ready_chan():
+				role := zdd.stage.Role
+				if err != nil {
+					log.Errorf("The replacement of %s (PID %d) isn't ready, keeping PID %d: %v", role, zdd.pid, zdd.old, err)
+					zdd.pump.abandon()
+					retiring[zdd.pid] = role
+					zdd = nil
+					continue
+				}
+				log.Infof("Switching %s over from PID %d to PID %d", role, zdd.old, zdd.pid)
+				zdd.pump.switch_over()
+				retiring[zdd.old] = role
+				running[role] = zdd.pid
+				s.metrics.SetPid(role, zdd.pid)
+				s.track_children(running)
+				zdd = nil
+			case <-ctx.Done():
+				log.Info("shutting down")
+				s.emit(Event{Type: EventShuttingDown})
+				break wait
+			case req := <-s.control:
+				switch req.command {
+				case "status":
+					// Copies, the reply is used in another goroutine.
+					status := &Status{
+						Pids:          maps.Clone(running),
+						Restarts:      maps.Clone(restarts),
+						UptimeSeconds: time.Since(start_time).Seconds(),
+						Pumped:        s.metrics.PumpedCounts(),
+					}
+					s.metrics.stage_status(status)
+					req.reply <- control_reply{status: status}
+				case "restart", "restart_stage":
+					if req.command == "restart_stage" && opts.IndependentRestart {
+						pid, ok := running[req.role]
+						if !ok || !s.request_stop(pid) {
+							req.reply <- control_reply{err: fmt.Errorf("%s is not running", req.role)}
+							continue
+						}
+						log.Warningf("Restarting %s (PID %d) as requested", req.role, pid)
+						req.reply <- control_reply{}
+						continue
+					}
+					if opts.ZeroDowntime {
+						stage := pipeline[len(pipeline)-1]
+						if zdd != nil {
+							req.reply <- control_reply{err: fmt.Errorf("%s is already being replaced", stage.Role)}
+							continue
+						}
+						pump := hub.(*Pump)
+						fd, err := pump.replace(stage, comms)
+						if err != nil {
+							req.reply <- control_reply{err: fmt.Errorf("cannot replace %s: %v", stage.Role, err)}
+							continue
+						}
+						log.Warningf("Replacing %s (PID %d) as requested through the control API", stage.Role, running[stage.Role])
+						zdd = &replacement{pump: pump, stage: stage, old: running[stage.Role], fd: fd, ready: make(chan error, 1)}
+						req.reply <- control_reply{}
+						continue
+					}
+					log.Warning("Restart requested")
+					s.emit(Event{Type: EventRestarting})
+					req.reply <- control_reply{}
+					forced_restart = true
+					break wait
+				default:
+					req.reply <- control_reply{err: fmt.Errorf("unknown command %q", req.command)}
+				}
+			}
+		}
+		if zdd != nil {
+			if zdd.pid == 0 {
+				stage_fds[zdd.stage.Role] = zdd.fd
+			} else {
+				retiring[zdd.pid] = zdd.stage.Role
+			}
+		}
+		if ctx.Err() != nil && opts.DrainTimeout > 0 && run_err == nil {
+			s.drain(pipeline[0].Role, comms, running, stage_fds, retiring)
+		}
+		// The others may have ended by themselves too, e.g. a consumer
+		// that got EOF from a producer that failed.
+		for _, e := range s.stop_children(stop_run, comms, running, stage_fds, retiring) {
+			log_exit(e)
+			if opts.Policy == Once {
+				once_exit(e)
+			}
+			exits = append(exits, e)
+		}
+		s.track_children(nil)
+		if hub != nil {
+			hub.Wait()
+		}
+		if run_err != nil {
+			return run_err
+		}
+		s.metrics.ObserveRun(time.Since(started))
+		for _, stage := range pipeline {
+			s.metrics.SetPid(stage.Role, 0)
+		}
+		if ctx.Err() != nil || s.draining.Load() {
+			break
+		}
+		if forced_restart {
+			continue
+		}
+
+		if opts.Policy == Once {
+			if failed != nil {
+				return &ExitError{Role: failed.Role, Index: stage_index(pipeline, failed.Role), Status: failed.Status}
+			}
+			return nil
+		}
+
+		if len(exits) == 0 {
+			exits = []ChildEvent{ev}
+		}
+		// The restart is that of the stage that failed, as for
+		// decide_restart.
+		ev = first_failure(exits)
+		plan, err := s.decide_restart(&opts, &r, exits, time.Now())
+		if err != nil {
+			return err
+		}
+		if plan.stop {
+			break
+		}
+		if plan.rate_wait > 0 && !s.sleep(ctx, plan.rate_wait) {
+			continue
+		}
+		delay := plan.delay
+		log.Infof("restarting in %v", delay)
+		s.restarted(ev.Role, restarts)
+		s.emit(Event{Type: EventRestarting, Role: ev.Role, DelaySeconds: delay.Seconds()})
+		if s.sleep(ctx, delay) {
+			if err := s.on_restart(ctx, ev); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// log_exit logs the exit of the stage that ended a run or has to be
+// restarted, saying whether it failed.
+func log_exit(ev ChildEvent) {
+	fields := Fields{"role": ev.Role, "pid": ev.Pid, "exit_status": ev.Status.ExitStatus()}
+	how := fmt.Sprintf("exit %d", ev.Status.ExitStatus())
+	if ev.Status.Signaled() {
+		how = unix.SignalName(ev.Status.Signal())
+	}
+	switch {
+	case ev.TimedOut:
+		log.Error(WithFields(fmt.Sprintf("%s failed (timed out, %s)", ev.Role, how), fields))
+	case ev.Unhealthy:
+		log.Error(WithFields(fmt.Sprintf("%s failed (unhealthy, %s)", ev.Role, how), fields))
+	case succeeded(ev):
+		log.Info(WithFields(fmt.Sprintf("%s finished (%s)", ev.Role, how), fields))
+	default:
+		log.Error(WithFields(fmt.Sprintf("%s failed (%s)", ev.Role, how), fields))
+	}
+}
+
+// stage_index returns the position of role in pipeline.
+func stage_index(pipeline []Stage, role string) int {
+	for i, stage := range pipeline {
+		if stage.Role == role {
+			return i
+		}
+	}
+	return -1
+}
+
+// succeeded reports whether ev is the exit of a child that exited 0 by
+// itself, rather than being stopped for running too long or failing its
+// health checks.
+func succeeded(ev ChildEvent) bool {
+	return !ev.TimedOut && !ev.Unhealthy && ev.Status.Exited() && ev.Status.ExitStatus() == 0
+}
+
+// flap_delay records a restart at now that is due in delay, and returns
+// the delay to use instead if the pipeline is flapping, see
+// Options.FlapThreshold. The count starts over after a cooldown.
+func (s *Supervisor) flap_delay(delay time.Duration, now time.Time) time.Duration {
+	if s.flaps.Max <= 0 {
+		return delay
+	}
+	s.flaps.Record(now)
+	if !s.flaps.Exceeded(now) {
+		return delay
+	}
+	log.Warningf("pipeline is flapping, more than %d restarts in %v, cooling down for %v", s.flaps.Max, s.flaps.Window, s.opts.FlapCooldown)
+	s.flaps.Reset()
+	return max(delay, s.opts.FlapCooldown)
+}
+
+// sleep sleeps for d, waking early if ctx is cancelled. It returns false
+// if the sleep was cut short.
+func (s *Supervisor) sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// next_backoff doubles the current delay, capped at BackoffMax. A zero
+// base disables the backoff entirely.
+func (s *Supervisor) next_backoff(current time.Duration) time.Duration {
+	if current <= 0 {
+		return 0
+	}
+	next := current * 2
+	if next > s.opts.BackoffMax || next <= 0 {
+		next = s.opts.BackoffMax
+	}
+	return next
+}
+
+// stop_children cancels the run, which has the watch routines stop
+// their children, and waits for every child in running, which maps role
+// to PID, to be reaped. Stages in respawning, which maps role to the
+// child's end of its pipe, have been respawned but not yet reported
+// their start; they are waited for too, and their fds closed. So are
+// the children in others, by PID, that are no longer in running. It
+// returns the exits of the stages that ended by themselves meanwhile.
+func (s *Supervisor) stop_children(stop_run context.CancelFunc, comms chan ChildEvent, running map[string]uintptr, respawning map[string]int, others map[uintptr]string) []ChildEvent {
+	var exits []ChildEvent
+	stopped := 0
+	stop_run()
+	// Waited for by PID, a stage being replaced has two children.
+	pending := make(map[uintptr]bool)
+	for _, pid := range running {
+		pending[pid] = true
+	}
+	for pid := range others {
+		pending[pid] = true
+	}
+	for len(pending) > 0 || len(respawning) > 0 {
+		ev := <-comms
+		if !ev.Exited {
+			syscall.Close(respawning[ev.Role])
+			delete(respawning, ev.Role)
+			if ev.Err == nil {
+				pending[ev.Pid] = true
+			}
+			continue
+		}
+		delete(pending, ev.Pid)
+		if _, ok := others[ev.Pid]; ok {
+			continue
+		}
+		if ev.Stopped || ev.Requested {
+			stopped++
+		} else {
+			exits = append(exits, ev)
+		}
+	}
+	if stopped > 0 {
+		log.Infof("Stopped %d children", stopped)
+	}
+	return exits
+}
+
+// terminate stops a child once its run has been cancelled: StopSignal
+// first, then SIGKILL if it is still alive after StopTimeout. done
+// delivers the child's status once it has been reaped.
+func (s *Supervisor) terminate(role string, pid uintptr, done chan syscall.WaitStatus) syscall.WaitStatus {
+	log.Debugf("Sending %s to %s (PID %d)", unix.SignalName(s.opts.StopSignal), role, pid)
+	s.kill(pid, s.opts.StopSignal)
+	timer := time.NewTimer(s.opts.StopTimeout)
+	defer timer.Stop()
+	select {
+	case status := <-done:
+		return status
+	case <-timer.C:
+		log.Warningf("%s (PID %d) did not stop within %v, sending SIGKILL", role, pid, s.opts.StopTimeout)
+		s.kill(pid, syscall.SIGKILL)
+	}
+	return <-done
+}
@@ -0,0 +1,213 @@
+package supervisor_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/msoulier/mrun/supervisor"
+)
+
+// look_path returns the path of program, skipping the test without it.
+func look_path(t *testing.T, program string) string {
+	t.Helper()
+	path, err := exec.LookPath(program)
+	if err != nil {
+		t.Skipf("no %s: %v", program, err)
+	}
+	return path
+}
+
+// open_fds counts our open file descriptors.
+func open_fds(t *testing.T) int {
+	t.Helper()
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skipf("cannot count the open fds: %v", err)
+	}
+	return len(entries)
+}
+
+func TestRestartsDontLeakFds(t *testing.T) {
+	const restarts = 300
+	s, err := supervisor.New(supervisor.Options{
+		Stages: []supervisor.Stage{
+			{Role: "producer", Path: look_path(t, "true")},
+			{Role: "consumer", Path: look_path(t, "cat")},
+		},
+		StopTimeout: time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := open_fds(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	go func() {
+		count := 0
+		for ev := range s.Events() {
+			if ev.Type == supervisor.EventRestarting {
+				if count++; count == restarts {
+					s.Stop()
+				}
+			}
+		}
+	}()
+	if err := s.Run(ctx); err != nil {
+		t.Fatalf("Run returned %v", err)
+	}
+	if ctx.Err() != nil {
+		t.Fatal("the restarts took too long")
+	}
+	// A few for the runtime, e.g. a pidfd or the epoll of the poller.
+	if after := open_fds(t); after > before+4 {
+		t.Errorf("%d fds open after %d restarts, %d before", after, restarts, before)
+	}
+}
+
+func TestConsumerSeesEOF(t *testing.T) {
+	var out bytes.Buffer
+	s, err := supervisor.New(supervisor.Options{
+		Stages: []supervisor.Stage{
+			{Role: "producer", Path: look_path(t, "echo"), Args: []string{"hello"}},
+			{Role: "consumer", Path: look_path(t, "wc"), Args: []string{"-c"}},
+		},
+		Policy:      supervisor.Once,
+		Stdout:      &out,
+		StopTimeout: time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// If anything but the producer held the write end of its pipe, e.g.
+	// another child for want of O_CLOEXEC, wc would wait for ever.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.Run(ctx); err != nil {
+		t.Fatalf("Run returned %v", err)
+	}
+	if ctx.Err() != nil {
+		t.Fatal("the consumer didn't see EOF")
+	}
+	if got := strings.TrimSpace(out.String()); got != "6" {
+		t.Errorf("the consumer counted %q bytes, want 6", got)
+	}
+}
+
+func TestRestartOnFailureSeesEveryExit(t *testing.T) {
+	// cat gets EOF and exits 0 as the producer fails, and its exit is
+	// often the first in; it mustn't pass for the whole pipeline's.
+	for range 10 {
+		s, err := supervisor.New(supervisor.Options{
+			Stages: []supervisor.Stage{
+				{Role: "producer", Path: look_path(t, "sh"), Args: []string{"-c", "exit 1"}},
+				{Role: "consumer", Path: look_path(t, "cat")},
+			},
+			RestartOnFailure: true,
+			MaxRestarts:      2,
+			BackoffBase:      time.Millisecond,
+			BackoffMax:       time.Millisecond,
+			MinHealthy:       time.Minute,
+			StopTimeout:      time.Second,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err = s.Run(ctx)
+		cancel()
+		if !errors.Is(err, supervisor.ErrMaxRestarts) {
+			t.Fatalf("Run returned %v, want ErrMaxRestarts", err)
+		}
+	}
+}
+
+func TestNoRestartFailsWithTheFailingStage(t *testing.T) {
+	for range 10 {
+		s, err := supervisor.New(supervisor.Options{
+			Stages: []supervisor.Stage{
+				{Role: "producer", Path: look_path(t, "sh"), Args: []string{"-c", "exit 5"}},
+				{Role: "consumer", Path: look_path(t, "cat")},
+			},
+			Policy:      supervisor.NoRestart,
+			StopTimeout: time.Second,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err = s.Run(ctx)
+		cancel()
+		var exit *supervisor.ExitError
+		if !errors.As(err, &exit) || exit.Role != "producer" || exit.Index != 0 || exit.Status.ExitStatus() != 5 {
+			t.Fatalf("Run returned %v, want the producer's exit 5", err)
+		}
+	}
+}
+
+func TestRestartsChargedToTheFailingStage(t *testing.T) {
+	for range 5 {
+		s, err := supervisor.New(supervisor.Options{
+			Stages: []supervisor.Stage{
+				{Role: "producer", Path: look_path(t, "sh"), Args: []string{"-c", "exit 1"}},
+				{Role: "consumer", Path: look_path(t, "cat")},
+			},
+			MaxRestarts: 3,
+			BackoffBase: time.Millisecond,
+			BackoffMax:  time.Millisecond,
+			MinHealthy:  time.Minute,
+			StopTimeout: time.Second,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err = s.Run(ctx)
+		cancel()
+		if !errors.Is(err, supervisor.ErrMaxRestarts) {
+			t.Fatalf("Run returned %v, want ErrMaxRestarts", err)
+		}
+		restarts, last_exit := s.Metrics().Totals()
+		if restarts["producer"] != 3 || restarts["consumer"] != 0 {
+			t.Fatalf("counted restarts %v, want 3 of the producer", restarts)
+		}
+		if last_exit["producer"] != 1 {
+			t.Fatalf("last exit statuses %v, want 1 for the producer", last_exit)
+		}
+	}
+}
+
+func TestFanInOnceEnds(t *testing.T) {
+	var out bytes.Buffer
+	s, err := supervisor.New(supervisor.Options{
+		Stages: []supervisor.Stage{
+			{Role: "producer-1", Path: look_path(t, "seq"), Args: []string{"1", "1000"}},
+			{Role: "producer-2", Path: look_path(t, "seq"), Args: []string{"1001", "2000"}},
+			{Role: "consumer", Path: look_path(t, "wc"), Args: []string{"-l"}},
+		},
+		Topology:    supervisor.FanIn,
+		Policy:      supervisor.Once,
+		Stdout:      &out,
+		StopTimeout: time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The consumer only exits once it has EOF, after both producers.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.Run(ctx); err != nil {
+		t.Fatalf("Run returned %v", err)
+	}
+	if ctx.Err() != nil {
+		t.Fatal("the consumer didn't see EOF")
+	}
+	if got := strings.TrimSpace(out.String()); got != "2000" {
+		t.Errorf("the consumer counted %q lines, want 2000", got)
+	}
+}
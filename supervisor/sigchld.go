@@ -0,0 +1,64 @@
+package supervisor
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// How often a child that is being waited for is checked on without a
+// SIGCHLD, in case one got lost.
+const wait_poll = time.Second
+
+var (
+	sigchld_once sync.Once
+	sigchld_mu   sync.Mutex
+	// Closed, and replaced, on every SIGCHLD.
+	sigchld_next chan struct{}
+)
+
+// next_sigchld returns a channel that is closed on the next SIGCHLD.
+// Get it before checking on a child, so that an exit in between isn't
+// missed.
+func next_sigchld() <-chan struct{} {
+	sigchld_once.Do(func() {
+		sigchld_next = make(chan struct{})
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGCHLD)
+		go func() {
+			for range sigs {
+				sigchld_mu.Lock()
+				close(sigchld_next)
+				sigchld_next = make(chan struct{})
+				sigchld_mu.Unlock()
+			}
+		}()
+	})
+	sigchld_mu.Lock()
+	defer sigchld_mu.Unlock()
+	return sigchld_next
+}
+
+// wait_until calls check, which must not block, until it returns true
+// or an error, once at first and then whenever a child has changed
+// state. The waiting doesn't tie up a thread the way a blocking wait4
+// does, one for every child for as long as it runs.
+func wait_until(check func() (bool, error)) error {
+	for {
+		next := next_sigchld()
+		var done bool
+		err := ignoring_eintr(func() (err error) {
+			done, err = check()
+			return err
+		})
+		if done || err != nil {
+			return err
+		}
+		select {
+		case <-next:
+		case <-time.After(wait_poll):
+		}
+	}
+}
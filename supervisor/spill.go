@@ -0,0 +1,80 @@
+package supervisor
+
+import (
+	"os"
+)
+
+// spill is a ring buffer in an unlinked temporary file, holding the
+// data for a consumer that is down. Offsets count every byte ever
+// written; the data between roff and woff is what's left to replay.
+type spill struct {
+	f          *os.File
+	size       int64
+	roff, woff int64
+	// Whoever is replaying, see Tee.replay.
+	reader *os.File
+	// Set once the buffer has overflowed, to log it once.
+	full bool
+}
+
+func new_spill(role string, size int64) (*spill, error) {
+	f, err := os.CreateTemp("", "mrun-spill-"+role+"-")
+	if err != nil {
+		return nil, err
+	}
+	// Nobody else needs to see it, and it goes away with us.
+	os.Remove(f.Name())
+	return &spill{f: f, size: size}, nil
+}
+
+// len returns the number of bytes waiting to be replayed.
+func (sp *spill) len() int64 {
+	return sp.woff - sp.roff
+}
+
+// room returns the number of bytes that fit without dropping any.
+func (sp *spill) room() int64 {
+	return sp.size - sp.len()
+}
+
+// write appends p, dropping the oldest data to make room if needed.
+func (sp *spill) write(p []byte) error {
+	if int64(len(p)) > sp.size {
+		sp.roff += int64(len(p)) - sp.size
+		sp.woff += int64(len(p)) - sp.size
+		p = p[int64(len(p))-sp.size:]
+	}
+	if over := int64(len(p)) - sp.room(); over > 0 {
+		sp.roff += over
+	}
+	for len(p) > 0 {
+		pos := sp.woff % sp.size
+		n := min(int64(len(p)), sp.size-pos)
+		if _, err := sp.f.WriteAt(p[:n], pos); err != nil {
+			return err
+		}
+		sp.woff += n
+		p = p[n:]
+	}
+	return nil
+}
+
+// peek reads the oldest data into buf without consuming it.
+func (sp *spill) peek(buf []byte) (int, error) {
+	pos := sp.roff % sp.size
+	n := min(int64(len(buf)), sp.len(), sp.size-pos)
+	if n == 0 {
+		return 0, nil
+	}
+	return sp.f.ReadAt(buf[:n], pos)
+}
+
+// discard consumes n bytes read by peek from offset from. Some may have
+// been dropped in the meantime.
+func (sp *spill) discard(from int64, n int) {
+	sp.roff = max(sp.roff, from+int64(n))
+}
+
+func (sp *spill) close() {
+	sp.f.Close()
+}
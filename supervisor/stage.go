@@ -0,0 +1,231 @@
+package supervisor
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Stage is one program in the pipeline. stdout of each stage is piped to
+// stdin of the next.
+type Stage struct {
+	// Names the stage in logs, metrics and the status, e.g. producer,
+	// consumer or stage-N. Roles must be unique within a pipeline.
+	Role string
+	// Absolute path of the program, there is no PATH lookup.
+	Path string
+	Args []string
+	// Working directory, or "" to inherit ours.
+	Dir string
+	// Niceness of the child, nil to inherit ours.
+	Nice *int
+	// Written to the child's /proc/self/oom_score_adj, -1000 to 1000, nil
+	// to inherit ours. Failing to is only a warning.
+	OOMScoreAdj *int
+	// Checks that the child is alive and well, looked up in PATH, see
+	// Options.HealthInterval. nil if there is nothing to check.
+	HealthCommand []string
+	// How long to wait before the first start of the child, or before
+	// every start with Options.StartDelayOnRestart. A stop cuts it short.
+	StartDelay time.Duration
+	// If set, this file is opened for every start of a stage that would
+	// read our stdin, the first, and is its stdin instead.
+	StdinFile string
+}
+
+// delay_start waits for the StartDelay of stage, if this start has one.
+// It returns false if ctx was cancelled meanwhile.
+func (s *Supervisor) delay_start(ctx context.Context, stage Stage) bool {
+	if stage.StartDelay <= 0 {
+		return true
+	}
+	s.children_mu.Lock()
+	starts := s.starts[stage.Role]
+	s.children_mu.Unlock()
+	if starts > 0 && !s.opts.StartDelayOnRestart {
+		return true
+	}
+	log.Infof("Starting %s in %v", stage.Role, stage.StartDelay)
+	return s.sleep(ctx, stage.StartDelay)
+}
+
+// watch_stage starts stage with infd as its stdin and outfd as its
+// stdout; either may be -1 to inherit ours. The start and the exit of the
+// child are reported on comms, or a failed start as a start event
+// carrying the error. Once ctx is cancelled the child is terminated.
+//
+// The child is started by the Launcher, see launcher.go. A child that
+// needs setting up first execs a copy of ourselves, see exec.go.
+//
+// Start only returns once the child holds its own copies of infd and
+// outfd. The start event is the acknowledgment the parent waits for
+// before closing its copies; nothing may be sent on comms before it.
+func (s *Supervisor) watch_stage(ctx context.Context, stage Stage, infd int, outfd int, comms chan ChildEvent) {
+	log.Debugf("starting watch_stage for %s", stage.Role)
+	if !s.delay_start(ctx, stage) {
+		comms <- ChildEvent{Role: stage.Role, Err: ctx.Err()}
+		return
+	}
+	path, env, cred, err := s.exec_path(stage)
+	if err != nil {
+		comms <- ChildEvent{Role: stage.Role, Err: fmt.Errorf("cannot start %s: %v", stage.Role, err)}
+		return
+	}
+	files := []uintptr{uintptr(s.std.stdin), uintptr(s.std.stdout), uintptr(syscall.Stderr)}
+	// The pipe ends stay blocking: they become the child's stdin and
+	// stdout, and most programs don't expect EAGAIN there.
+	if infd >= 0 {
+		files[0] = uintptr(infd)
+	}
+	filefd := -1
+	if infd < 0 && stage.StdinFile != "" {
+		fd, err := open_stdin_file(stage.StdinFile)
+		if err != nil {
+			comms <- ChildEvent{Role: stage.Role, Err: fmt.Errorf("cannot start %s: %v", stage.Role, err)}
+			return
+		}
+		filefd = fd
+		files[0] = uintptr(filefd)
+	}
+	if outfd >= 0 {
+		files[1] = uintptr(outfd)
+	}
+	errfd := -1
+	if s.opts.CaptureStderr {
+		fd, err := capture_stderr(stage.Role)
+		if err != nil {
+			log.Warningf("Cannot capture the stderr of %s, leaving it alone: %v", stage.Role, err)
+		} else {
+			errfd = fd
+			files[2] = uintptr(errfd)
+		}
+	}
+	// argv[0] is always the basename of the script.
+	argv := append([]string{filepath.Base(stage.Path)}, stage.Args...)
+	log.Debugf("calling exec on %s", stage.Path)
+	proc, err := s.launcher().Start(ProcSpec{
+		Role:         stage.Role,
+		Path:         path,
+		Argv:         argv,
+		Dir:          stage.Dir,
+		Env:          env,
+		Files:        files,
+		Credential:   cred,
+		ProcessGroup: !s.opts.NoProcessGroup,
+		StopSignal:   s.opts.StopSignal,
+	})
+	if errfd >= 0 {
+		// The child has its own copy, or failed to start.
+		syscall.Close(errfd)
+	}
+	if filefd >= 0 {
+		syscall.Close(filefd)
+	}
+	if err != nil {
+		comms <- ChildEvent{Role: stage.Role, Err: fmt.Errorf("cannot start %s: %v", stage.Role, err)}
+		return
+	}
+	pid := uintptr(proc.Pid())
+	started := time.Now()
+	requested := s.forked_child(stage.Role, proc)
+	s.metrics.Forked(stage.Role, pid, started)
+	if s.cgroup != nil {
+		if err := s.cgroup.add(pid); err != nil {
+			log.Warningf("Cannot move %s (PID %d) into cgroup %s: %v", stage.Role, pid, s.cgroup.path, err)
+		}
+	}
+	comms <- ChildEvent{Role: stage.Role, Pid: pid}
+	s.emit(Event{Type: EventStarted, Role: stage.Role, Pid: pid})
+
+	// Wait blocks, so it gets a goroutine of its own.
+	done := make(chan syscall.WaitStatus, 1)
+	go func() {
+		status, err := proc.Wait()
+		if err != nil {
+			log.Errorf("Waiting for %s (PID %d) failed: %v", stage.Role, pid, err)
+		}
+		done <- status
+	}()
+	var timeout <-chan time.Time
+	if s.opts.RunTimeout > 0 {
+		timer := time.NewTimer(s.opts.RunTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	var unhealthy chan struct{}
+	if len(stage.HealthCommand) > 0 {
+		unhealthy = make(chan struct{})
+		health_ctx, stop_health := context.WithCancel(ctx)
+		defer stop_health()
+		go s.watch_health(health_ctx, stage, pid, unhealthy)
+	}
+	var status syscall.WaitStatus
+	timed_out, failed_health, restarted, stopped := false, false, false, false
+	select {
+	case status = <-done:
+	case <-ctx.Done():
+		if proc.HasExited() {
+			// By itself, just as the run was stopped.
+			status = <-done
+		} else {
+			stopped = true
+			status = s.terminate(stage.Role, pid, done)
+		}
+	case <-timeout:
+		log.Warningf("%s (PID %d) still running after %v, stopping it", stage.Role, pid, s.opts.RunTimeout)
+		timed_out = true
+		status = s.terminate(stage.Role, pid, done)
+	case <-unhealthy:
+		log.Warningf("%s (PID %d) is unhealthy, stopping it", stage.Role, pid)
+		failed_health = true
+		status = s.terminate(stage.Role, pid, done)
+	case <-requested:
+		log.Infof("Stopping %s (PID %d) to restart it", stage.Role, pid)
+		restarted = true
+		status = s.terminate(stage.Role, pid, done)
+	}
+	fields := Fields{"role": stage.Role, "pid": pid, "exit_status": status.ExitStatus()}
+	if status.Signaled() {
+		fields["signal"] = unix.SignalName(status.Signal())
+	}
+	log.Info(WithFields(fmt.Sprintf("%s process (PID %d) %s", stage.Role, pid, describe_status(status)), fields))
+
+	s.reaped_child(stage.Role, pid)
+	s.metrics.Reaped(stage.Role, pid, time.Now(), status)
+	s.emit(exit_event(stage.Role, pid, status))
+	comms <- ChildEvent{Role: stage.Role, Pid: pid, Exited: true, Status: status, TimedOut: timed_out, Unhealthy: failed_health, Ran: time.Since(started), Requested: restarted, Stopped: stopped}
+}
+
+// describe_status says how a child ended, for the logs.
+func describe_status(status syscall.WaitStatus) string {
+	if status.Signaled() {
+		return "killed by " + unix.SignalName(status.Signal())
+	}
+	return fmt.Sprintf("exited with status %d", status.ExitStatus())
+}
+
+// exit_code turns status into an exit code the way a shell does,
+// 128+signal for a child killed by a signal.
+func exit_code(status syscall.WaitStatus) int {
+	if status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return status.ExitStatus()
+}
+
+// open_stdin_file opens path for reading, to be the stdin of a child.
+func open_stdin_file(path string) (int, error) {
+	var fd int
+	err := ignoring_eintr(func() (err error) {
+		fd, err = unix.Open(path, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+		return err
+	})
+	if err != nil {
+		return -1, fmt.Errorf("cannot open %s: %v", path, err)
+	}
+	return fd, nil
+}
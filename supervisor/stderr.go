@@ -0,0 +1,39 @@
+package supervisor
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+)
+
+// capture_stderr creates a pipe for the stderr of role and logs whatever
+// comes out of it a line at a time. It returns the write end, for the
+// child, which the caller has to close once the child has started.
+func capture_stderr(role string) (int, error) {
+	pipes, err := make_pipes(1)
+	if err != nil {
+		return -1, err
+	}
+	go log_lines(role, os.NewFile(uintptr(pipes[0][0]), role+" stderr"))
+	return pipes[0][1], nil
+}
+
+// log_lines logs each line read from r until EOF, including a final
+// line without a newline.
+func log_lines(role string, r *os.File) {
+	defer r.Close()
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if line = strings.TrimRight(line, "\r\n"); line != "" {
+			log.Info(WithFields("["+role+" stderr] "+line, Fields{"role": role, "stream": "stderr"}))
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Errorf("Reading the stderr of %s failed: %v", role, err)
+			}
+			return
+		}
+	}
+}
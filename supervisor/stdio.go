@@ -0,0 +1,92 @@
+package supervisor
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// stdio is what the stages that aren't piped to another stage get as
+// their stdin and stdout: ours, or pipes from Options.Stdin and to
+// Options.Stdout.
+type stdio struct {
+	stdin  int
+	stdout int
+	// Our ends of the pipes, nil without.
+	in  *os.File
+	out *os.File
+	// Closed once the output of the children is all in Options.Stdout.
+	copied chan struct{}
+}
+
+// open_stdio sets up the pipes for Options.Stdin and Options.Stdout and
+// starts copying through them.
+func (s *Supervisor) open_stdio() error {
+	std := &stdio{stdin: syscall.Stdin, stdout: syscall.Stdout}
+	// Only our ends are made non-blocking, so that closing them ends a
+	// copy that is stuck. The children's ends are separate file
+	// descriptions and stay blocking.
+	if s.opts.Stdin != nil {
+		pipes, err := make_pipes(1)
+		if err != nil {
+			return err
+		}
+		unix.SetNonblock(pipes[0][1], true)
+		std.stdin = pipes[0][0]
+		std.in = os.NewFile(uintptr(pipes[0][1]), "stdin")
+		go func() {
+			if _, err := io.Copy(std.in, s.opts.Stdin); err != nil && !closed_pipe(err) {
+				log.Warningf("Cannot copy Options.Stdin to the pipeline: %v", err)
+			}
+			// The stages reading it see EOF.
+			std.in.Close()
+		}()
+	}
+	if s.opts.Stdout != nil {
+		pipes, err := make_pipes(1)
+		if err != nil {
+			std.close(0)
+			return err
+		}
+		unix.SetNonblock(pipes[0][0], true)
+		std.stdout = pipes[0][1]
+		std.out = os.NewFile(uintptr(pipes[0][0]), "stdout")
+		std.copied = make(chan struct{})
+		go func() {
+			defer close(std.copied)
+			if _, err := io.Copy(s.opts.Stdout, std.out); err != nil && !closed_pipe(err) {
+				log.Warningf("Cannot copy the output of the pipeline to Options.Stdout: %v", err)
+			}
+		}()
+	}
+	s.std = std
+	return nil
+}
+
+// close closes the pipes once the children are gone. It waits up to
+// timeout for their output to be copied, in case something they started
+// still holds the pipe.
+func (std *stdio) close(timeout time.Duration) {
+	if std.in != nil {
+		syscall.Close(std.stdin)
+		std.in.Close()
+	}
+	if std.out != nil {
+		syscall.Close(std.stdout)
+		select {
+		case <-std.copied:
+		case <-time.After(timeout):
+			log.Warningf("The output of the pipeline is still open after %v, not copying any more of it", timeout)
+		}
+		std.out.Close()
+	}
+}
+
+// closed_pipe reports whether err is only that a pipe was closed.
+func closed_pipe(err error) bool {
+	return errors.Is(err, os.ErrClosed) || errors.Is(err, syscall.EPIPE)
+}
@@ -0,0 +1,604 @@
+// Package supervisor runs a pipeline of programs connected by pipes and
+// restarts it when one of them exits.
+package supervisor
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+var log = logging.MustGetLogger("mrun")
+
+// SetLogModule logs as module instead of mrun from now on, for the
+// module levels of go-logging. Call it before Run.
+func SetLogModule(module string) {
+	log = logging.MustGetLogger(module)
+}
+
+// Policy says what to do when a stage exits.
+type Policy int64
+
+const (
+	Restart Policy = iota
+	// Stop the pipeline when a stage exits.
+	NoRestart
+	// Run the pipeline a single time, letting every stage run to the
+	// end.
+	Once
+)
+
+// Topology says how the stages are connected.
+type Topology int
+
+const (
+	// Each stage's stdout is piped to the next one's stdin.
+	Linear Topology = iota
+	// The first stage's stdout is copied to the stdin of all the others.
+	FanOut
+	// The stdout of all but the last stage is merged, line by line, onto
+	// the stdin of the last.
+	FanIn
+)
+
+// Options configures a Supervisor.
+type Options struct {
+	// The pipeline, in order.
+	Stages   []Stage
+	Topology Topology
+	// Environment of the children as KEY=VALUE pairs, nil for ours, to
+	// which the MRUN_ variables are added, see EnvRole.
+	Env []string
+	// Starts the children, nil to fork and exec them.
+	Launcher Launcher
+	// Read by the stages that would read our stdin, the first, and
+	// written by those that would write to our stdout, the last, through
+	// pipes that last as long as Run. A restarted stage carries on where
+	// the one before it stopped; once Stdin is at EOF, so is the stdin of
+	// every later child. Run returns once their output is in Stdout, or
+	// after StopTimeout if something still holds the pipe open. Read
+	// when Run starts.
+	Stdin  io.Reader
+	Stdout io.Writer
+	// If set, the children are switched to these before exec.
+	Credentials *Credentials
+	// Leave the children in our process group. By default each one
+	// gets a group of its own, and signals go to the whole group so
+	// that anything it started goes too.
+	NoProcessGroup bool
+	// Log the children's stderr line by line instead of letting them
+	// write to ours.
+	CaptureStderr bool
+	Policy        Policy
+	// Policies of single stages by role, overriding Policy when that
+	// stage exits. Restart or NoRestart.
+	StagePolicies map[string]Policy
+	// Only restart after a non-zero exit, stop when the stages that
+	// ended the run all exited 0.
+	RestartOnFailure bool
+	// Fixed delay before each restart, on top of the backoff.
+	RestartDelay time.Duration
+	// The backoff starts at BackoffBase and doubles with every failure
+	// up to BackoffMax. A stage that exits after running for MinHealthy
+	// resets it, and the count of consecutive failures.
+	BackoffBase time.Duration
+	BackoffMax  time.Duration
+	MinHealthy  time.Duration
+	// Give up after this many consecutive failures, 0 is unlimited.
+	MaxRestarts int
+	// Restart budget, a zero Max is unlimited. Give up if the budget
+	// stays exhausted for longer than RestartRateGrace.
+	RestartRate      RateLimit
+	RestartRateGrace time.Duration
+	// More than FlapThreshold restarts within FlapWindow, of the pipeline
+	// or of single stages, is flapping: the next restart waits
+	// FlapCooldown instead of the usual delay. A zero FlapThreshold never
+	// flaps.
+	FlapThreshold int
+	FlapWindow    time.Duration
+	FlapCooldown  time.Duration
+	// Resource limits of every child.
+	Rlimits []Rlimit
+	// The umask of every child, e.g. 0o027, nil for ours. Ours doesn't
+	// change.
+	Umask *int
+	// A cgroup v2 to run the children in, as a path below the cgroup2
+	// mount, e.g. "mrun/web". Run creates it if need be, with
+	// CgroupMemoryMax bytes as its memory.max and CgroupCPUMax CPUs,
+	// e.g. 1.5, as its cpu.max, 0 for no limit. Every child is moved
+	// into it right after it is forked. Run removes what it created when
+	// it returns. Without cgroup v2 the children run without and there
+	// is a warning. Read when Run starts, a Reload doesn't change it.
+	Cgroup          string
+	CgroupMemoryMax uint64
+	CgroupCPUMax    float64
+	// A child whose Stage.Nice can't be set exits instead of running at
+	// our niceness, with a warning on its stderr.
+	NiceRequired bool
+	// Sent to a child to stop it, SIGTERM if 0.
+	StopSignal syscall.Signal
+	// How long the children get to exit after StopSignal before SIGKILL.
+	StopTimeout time.Duration
+	// Stage.HealthCommand is run this often, and for at most this long.
+	// A stage that fails it HealthRetries times in a row is stopped and
+	// counts as failed.
+	HealthInterval time.Duration
+	HealthRetries  int
+	// A stage still running after this long is stopped and counts as
+	// failed, 0 is no limit.
+	RunTimeout time.Duration
+	// Size in bytes of the pipes between the stages, 0 for the system
+	// default.
+	PipeSize int
+	// Copy the data between the stages of a linear pipeline through
+	// mrun, counting it, with reads of up to PumpBuffer bytes.
+	Pump       bool
+	PumpBuffer int
+	// With Pump, the stdout of every stage but the last is a
+	// pseudo-terminal, for programs that behave differently on a
+	// terminal. See Resize.
+	Pty bool
+	// With Pump, what the first stage writes is also written here, as it
+	// goes to the next. A failed write is logged and the stream carries
+	// on without it.
+	Tee io.Writer
+	// With TCPAddr, "gzip" compresses the stream to every connection
+	// of the Bridge, and decompresses the consumer's again before it
+	// reads it, counting its compressed bytes in the metrics. "" leaves
+	// it alone.
+	Compress string
+	// With Pump, a stage that has not taken any of its input for this
+	// long is reported as stalled, 0 never is. StallRestart also stops
+	// it.
+	StallTimeout time.Duration
+	StallRestart bool
+	// In a linear pipeline, the first stage is only started once this
+	// command, looked up in PATH, exits 0. It is run every so often for
+	// at most ReadyTimeout, 0 waits forever, after which the run fails to
+	// start.
+	ReadyCommand []string
+	ReadyTimeout time.Duration
+	// If set, the PIDs of the children are kept in this file as JSON,
+	// see Status.Pids, and it is removed when Run returns.
+	PidsFile string
+	// Run this command, looked up in PATH, after a stage has exited and
+	// before it is started again, with MRUN_ROLE and MRUN_EXIT set to the
+	// role and exit code of the stage. If it fails the restart goes
+	// ahead, unless OnRestartRequired is set and Run returns the error.
+	OnRestart         []string
+	OnRestartRequired bool
+	// How long OnRestart may run, 0 waits forever. A hook that takes
+	// longer is killed and the restart goes ahead, OnRestartRequired or
+	// not.
+	HookTimeout time.Duration
+	// Commands run by Run before the pipeline is first started and after
+	// it has stopped for good, with the children's environment. If
+	// PreStart fails nothing is started and Run returns the error.
+	PreStart []string
+	PostStop []string
+	// With Pump, Restart replaces the last stage instead of restarting
+	// the pipeline: a new child is started next to the old one, and
+	// once it is ready, by ReadyCommand if set, the data goes to it and
+	// the old one is stopped. A stage that exits still restarts the
+	// pipeline.
+	ZeroDowntime bool
+	// In a linear pipeline, restart a stage that exits on its own, on the
+	// same pipes, instead of the whole pipeline. See Pipes.
+	IndependentRestart bool
+	// Wait for the Stage.StartDelay before every start, not just the
+	// first.
+	StartDelayOnRestart bool
+	// In a linear pipeline of two stages, also pipe the stdout of the
+	// consumer to the stdin of the producer, for a pair that talks both
+	// ways. Not with Pump.
+	Bidirectional bool
+	// On shutdown, stop the first stage only, and give the others this
+	// long after it has exited to finish what it sent them and exit on
+	// their own, before they are stopped too. 0 stops them all at once.
+	// Not with several producers or IndependentRestart, where the others
+	// never see EOF.
+	DrainTimeout time.Duration
+	// In a linear pipeline of two stages, carry the output of the
+	// producer to the consumer over TCP instead of a pipe: Run listens on
+	// this address, and the consumer reads from a connection to it. See
+	// Bridge. It is taken at the start of Run, a Reload doesn't change it.
+	TCPAddr string
+	// In a linear pipeline of two stages, connect them through the named
+	// pipe at this path instead of an anonymous one, so that others can
+	// open it too. Run creates it if it doesn't exist, and removes it
+	// again when done unless KeepFIFO is set. Like TCPAddr, it is taken at
+	// the start of Run.
+	FIFO     string
+	KeepFIFO bool
+	// In a fan-out pipeline, keep what the producer writes while a
+	// consumer is down in a temporary file, up to SpillMax bytes, and
+	// replay it when the consumer is back. Likewise for every stage but
+	// the first of a pumped linear pipeline with IndependentRestart.
+	// When it is full the oldest data is dropped, or with SpillBlock the
+	// writer is held back.
+	Spill      bool
+	SpillMax   int64
+	SpillBlock bool
+	// In a fan-out pipeline, give each line the producer writes to one
+	// consumer, in turn, instead of everything to every consumer. Each
+	// consumer has a buffer of BalanceBuffer lines, and BalanceWhenFull
+	// says what happens to a line for one whose buffer is full. Not with
+	// Spill.
+	Balance         bool
+	BalanceBuffer   int
+	BalanceWhenFull BalanceFull
+	// With Balance, pick the consumer of each line by a hash of its
+	// PartitionBy'th field, from 1, split at PartitionDelimiter, instead
+	// of in turn, so lines with the same key all go to the same one.
+	// Lines without that field go to the first consumer. BalanceSkip
+	// waits for a full buffer like BalanceBlock.
+	PartitionBy        int
+	PartitionDelimiter byte
+}
+
+// policy returns the policy that applies when role exits.
+func (opts *Options) policy(role string) Policy {
+	if policy, ok := opts.StagePolicies[role]; ok {
+		return policy
+	}
+	return opts.Policy
+}
+
+// Sent from the watch routines to Run when a child starts and again
+// when it exits.
+type ChildEvent struct {
+	Role   string
+	Pid    uintptr
+	Exited bool
+	Status syscall.WaitStatus
+	// Set if the child was stopped for exceeding Options.RunTimeout.
+	TimedOut bool
+	// Set if the child was stopped for failing its health checks.
+	Unhealthy bool
+	// On the exit event, how long the child ran.
+	Ran time.Duration
+	// Set if the child was stopped for Supervisor.RestartStage.
+	Requested bool
+	// Set if the child was stopped because its run was, rather than
+	// exiting by itself.
+	Stopped bool
+	// Set on the start event if the child could not be forked.
+	Err error
+}
+
+var (
+	// ErrMaxRestarts is returned by Run once Options.MaxRestarts is
+	// exceeded.
+	ErrMaxRestarts = errors.New("too many consecutive failures")
+	// ErrRateLimited is returned by Run once the restart rate has been
+	// exceeded for longer than Options.RestartRateGrace.
+	ErrRateLimited = errors.New("restart rate exceeded for too long")
+)
+
+// ExitError is returned by Run under the NoRestart policy when a stage
+// exits with a non-zero status, and under Once for the first stage that
+// did.
+type ExitError struct {
+	Role string
+	// Position of the stage in Options.Stages.
+	Index  int
+	Status syscall.WaitStatus
+}
+
+func (e *ExitError) Error() string {
+	return e.Role + " " + describe_status(e.Status)
+}
+
+// ExitCode turns the wait status into an exit code the way a shell
+// does, 128+signal for a child killed by a signal.
+func (e *ExitError) ExitCode() int {
+	return exit_code(e.Status)
+}
+
+// Supervisor runs one pipeline. Create it with New.
+type Supervisor struct {
+	opts         Options
+	restart_rate RateLimit
+	metrics      *Metrics
+	// Recent restarts, for Options.FlapThreshold.
+	flaps RateLimit
+	// The pipe size we last got, for logging changes.
+	pipe_size atomic.Int64
+
+	// Options passed to Reload, applied at the next restart.
+	mu   sync.Mutex
+	next *Options
+
+	stop      chan struct{}
+	stop_once sync.Once
+	// Set once a stop signal has been forwarded to the children, so the
+	// pipeline is not restarted when they exit.
+	draining atomic.Bool
+	control  chan control_request
+
+	children_mu sync.Mutex
+	children    map[string]uintptr
+	// The children as soon as they are forked, and how many times each
+	// role has been, for child_env.
+	forked map[string]uintptr
+	starts map[string]int
+	// Closed to have the watch routine of a child, by PID, stop it for
+	// RestartStage.
+	stop_child map[uintptr]chan struct{}
+	// The children until they are reaped, by PID, to signal them.
+	processes map[uintptr]Process
+	// Set while every stage has a running child. ready is closed the
+	// first time that happens.
+	healthy    atomic.Bool
+	ready      chan struct{}
+	ready_once sync.Once
+
+	events      chan Event
+	events_once sync.Once
+
+	ptys_mu sync.Mutex
+	ptys    map[*os.File]bool
+
+	// Set up by Run for Options.Cgroup, nil without.
+	cgroup *cgroup
+	// Set up by Run for Options.TCPAddr, nil without.
+	bridge *Bridge
+	// The Options.FIFO Run uses, "" without.
+	fifo string
+	// The stdin and stdout of the stages at the ends of the pipeline.
+	std *stdio
+}
+
+// New checks opts and returns a Supervisor for them. Nothing is started
+// until Run.
+func New(opts Options) (*Supervisor, error) {
+	s := &Supervisor{
+		metrics:    new_metrics(),
+		stop:       make(chan struct{}),
+		control:    make(chan control_request),
+		ready:      make(chan struct{}),
+		events:     make(chan Event, events_buffer),
+		forked:     make(map[string]uintptr),
+		starts:     make(map[string]int),
+		stop_child: make(map[uintptr]chan struct{}),
+		processes:  make(map[uintptr]Process),
+		ptys:       make(map[*os.File]bool),
+		std:        &stdio{stdin: syscall.Stdin, stdout: syscall.Stdout},
+	}
+	if err := s.apply(opts); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// apply checks opts and makes them the current options.
+func (s *Supervisor) apply(opts Options) error {
+	min := 2
+	if opts.Topology == Linear {
+		min = 1
+	}
+	if len(opts.Stages) < min {
+		return fmt.Errorf("the pipeline needs at least %d stages", min)
+	}
+	roles := make(map[string]bool)
+	for _, stage := range opts.Stages {
+		if stage.Role == "" || stage.Path == "" {
+			return fmt.Errorf("every stage needs a role and a path")
+		}
+		if roles[stage.Role] {
+			return fmt.Errorf("duplicate stage role %q", stage.Role)
+		}
+		if stage.StartDelay < 0 {
+			return fmt.Errorf("the start delay of %s can't be negative", stage.Role)
+		}
+		roles[stage.Role] = true
+	}
+	if opts.ZeroDowntime && (!opts.Pump || opts.Topology != Linear || len(opts.Stages) < 2) {
+		return fmt.Errorf("zero downtime restarts need a pumped linear pipeline")
+	}
+	if opts.Compress != "" && opts.Compress != "gzip" {
+		return fmt.Errorf("unknown compression %q", opts.Compress)
+	}
+	if opts.Compress != "" && opts.TCPAddr == "" {
+		return fmt.Errorf("compression needs a TCP bridge")
+	}
+	if opts.Tee != nil && !opts.Pump {
+		return fmt.Errorf("a tee needs a pumped pipeline")
+	}
+	if opts.Pty && !opts.Pump {
+		return fmt.Errorf("a pty needs a pumped pipeline")
+	}
+	if opts.IndependentRestart && (opts.Topology != Linear || opts.ZeroDowntime) {
+		return fmt.Errorf("independent restarts need a linear pipeline without zero downtime restarts")
+	}
+	if opts.Cgroup != "" && !filepath.IsLocal(opts.Cgroup) {
+		return fmt.Errorf("the cgroup must be a relative path below the cgroup2 mount, not %q", opts.Cgroup)
+	}
+	if opts.Cgroup == "" && (opts.CgroupMemoryMax > 0 || opts.CgroupCPUMax > 0) {
+		return fmt.Errorf("cgroup limits need a cgroup")
+	}
+	if opts.HookTimeout < 0 {
+		return fmt.Errorf("the hook timeout can't be negative")
+	}
+	if opts.Umask != nil && (*opts.Umask < 0 || *opts.Umask > 0o777) {
+		return fmt.Errorf("bad umask %o", *opts.Umask)
+	}
+	if opts.CgroupCPUMax < 0 {
+		return fmt.Errorf("the CPU limit of the cgroup can't be negative")
+	}
+	if opts.FlapThreshold > 0 && opts.FlapWindow <= 0 {
+		return fmt.Errorf("flapping detection needs a window")
+	}
+	if opts.Spill && opts.SpillMax <= 0 {
+		return fmt.Errorf("the spill buffer needs a size")
+	}
+	if opts.Spill && opts.Topology != FanOut && !(opts.Topology == Linear && opts.Pump && opts.IndependentRestart) {
+		return fmt.Errorf("spilling needs a fan-out pipeline, or a pumped linear one with independent restarts")
+	}
+	if opts.Balance && (opts.Topology != FanOut || opts.Spill) {
+		return fmt.Errorf("balancing needs a fan-out pipeline without spilling")
+	}
+	if opts.PartitionBy < 0 || (opts.PartitionBy > 0 && !opts.Balance) {
+		return fmt.Errorf("partitioning needs balancing, by a field from 1")
+	}
+	if opts.Balance && opts.BalanceBuffer <= 0 {
+		return fmt.Errorf("the balance buffer needs a size")
+	}
+	if opts.Bidirectional && (opts.Topology != Linear || len(opts.Stages) != 2 || opts.Pump) {
+		return fmt.Errorf("a bidirectional pipeline needs two stages and no pump")
+	}
+	if opts.Bidirectional && (opts.Stdin != nil || opts.Stdout != nil) {
+		return fmt.Errorf("a bidirectional pipeline has no stdin or stdout to copy")
+	}
+	if opts.TCPAddr != "" && (opts.Topology != Linear || len(opts.Stages) != 2 || opts.Pump || opts.Bidirectional || opts.IndependentRestart) {
+		return fmt.Errorf("TCP between the stages needs two stages, and no pump, second pipe or independent restarts")
+	}
+	if opts.FIFO != "" && (opts.Topology != Linear || len(opts.Stages) != 2 || opts.Pump || opts.Bidirectional || opts.TCPAddr != "") {
+		return fmt.Errorf("a FIFO between the stages needs two stages, and no pump, second pipe or TCP")
+	}
+	if opts.DrainTimeout > 0 && (opts.Topology == FanIn || opts.IndependentRestart) {
+		return fmt.Errorf("draining needs a single first stage and no independent restarts")
+	}
+	if len(opts.ReadyCommand) > 0 && opts.Topology != Linear {
+		return fmt.Errorf("a ready command needs a linear pipeline")
+	}
+	for _, stage := range opts.Stages {
+		if len(stage.HealthCommand) > 0 && (opts.HealthInterval <= 0 || opts.HealthRetries <= 0) {
+			return fmt.Errorf("the health check of %s needs an interval and a number of retries", stage.Role)
+		}
+	}
+	for role, policy := range opts.StagePolicies {
+		if !roles[role] {
+			return fmt.Errorf("policy for unknown stage %q", role)
+		}
+		if policy != Restart && policy != NoRestart {
+			return fmt.Errorf("the policy of %s must be Restart or NoRestart", role)
+		}
+	}
+	if opts.Env == nil {
+		opts.Env = Environ()
+	}
+	if opts.StopSignal == 0 {
+		opts.StopSignal = syscall.SIGTERM
+	}
+	if opts.BackoffMax < opts.BackoffBase {
+		opts.BackoffMax = opts.BackoffBase
+	}
+	// Keep the restart history unless the limit itself changed.
+	if opts.RestartRate.Max != s.restart_rate.Max || opts.RestartRate.Window != s.restart_rate.Window {
+		s.restart_rate = opts.RestartRate
+	}
+	if opts.FlapThreshold != s.flaps.Max || opts.FlapWindow != s.flaps.Window {
+		s.flaps = RateLimit{Max: opts.FlapThreshold, Window: opts.FlapWindow}
+	}
+	for _, stage := range opts.Stages {
+		s.metrics.AddRole(stage.Role)
+	}
+	if opts.PidsFile != s.opts.PidsFile {
+		s.remove_pids_file()
+	}
+	s.opts = opts
+	return nil
+}
+
+// Reload replaces the options. The running pipeline is left alone, the
+// new options take effect at the next restart.
+func (s *Supervisor) Reload(opts Options) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.next = &opts
+}
+
+// Stop asks Run to stop the pipeline and return. It is safe to call more
+// than once, and from any goroutine.
+func (s *Supervisor) Stop() {
+	s.stop_once.Do(func() {
+		close(s.stop)
+	})
+}
+
+// Drain makes Run return, instead of restarting, once the children have
+// exited. Use it after passing a stop signal on with Signal.
+func (s *Supervisor) Drain() {
+	s.draining.Store(true)
+}
+
+// Signal relays sig to every running child.
+func (s *Supervisor) Signal(sig syscall.Signal) {
+	s.children_mu.Lock()
+	children := maps.Clone(s.children)
+	s.children_mu.Unlock()
+	for role, pid := range children {
+		log.Debugf("Forwarding %v to %s (PID %d)", sig, role, pid)
+		s.kill(pid, sig)
+	}
+}
+
+// kill sends sig to the child pid, and to its process group unless
+// Options.NoProcessGroup is set. A child that has been reaped already is
+// left alone, its PID may have been reused.
+func (s *Supervisor) kill(pid uintptr, sig syscall.Signal) {
+	s.children_mu.Lock()
+	proc, ok := s.processes[pid]
+	s.children_mu.Unlock()
+	if ok {
+		proc.Signal(sig)
+	}
+}
+
+// child_pid returns the PID of the running child role, 0 if there is
+// none.
+func (s *Supervisor) child_pid(role string) uintptr {
+	s.children_mu.Lock()
+	defer s.children_mu.Unlock()
+	return s.children[role]
+}
+
+// Ready returns a channel that is closed once every stage of the
+// pipeline has started for the first time.
+func (s *Supervisor) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// Healthy reports whether every stage of the pipeline is running right
+// now.
+func (s *Supervisor) Healthy() bool {
+	return s.healthy.Load()
+}
+
+// Metrics returns the supervision counters.
+func (s *Supervisor) Metrics() *Metrics {
+	return s.metrics
+}
+
+// track_children records the PIDs of the current pipeline so Signal can
+// reach them, and updates Options.PidsFile and the health. Pass nil once
+// they have been reaped.
+func (s *Supervisor) track_children(running map[string]uintptr) {
+	s.children_mu.Lock()
+	defer s.children_mu.Unlock()
+	s.children = make(map[string]uintptr, len(running))
+	for role, pid := range running {
+		s.children[role] = pid
+	}
+	s.write_pids_file(running)
+	healthy := true
+	for _, stage := range s.opts.Stages {
+		if running[stage.Role] == 0 {
+			healthy = false
+		}
+	}
+	s.healthy.Store(healthy)
+	if healthy {
+		s.ready_once.Do(func() { close(s.ready) })
+	}
+}
@@ -0,0 +1,163 @@
+// Package supervisortest provides a supervisor.Launcher that starts no
+// processes, for testing what the supervisor does about exits, such as
+// backoff, max restarts and flapping, deterministically.
+package supervisortest
+
+import (
+	"sync"
+	"syscall"
+
+	"github.com/msoulier/mrun/supervisor"
+)
+
+// Launcher is a supervisor.Launcher whose children are Process values
+// that run until Exit is called or a signal ends them. Create it with
+// NewLauncher and set it as Options.Launcher.
+type Launcher struct {
+	mu       sync.Mutex
+	next     int
+	err      error
+	started  chan *Process
+	children []*Process
+}
+
+// NewLauncher returns a Launcher. Each child it starts is also sent on
+// Started, which buffers up to backlog of them; Start blocks once it is
+// full.
+func NewLauncher(backlog int) *Launcher {
+	return &Launcher{next: 1000, started: make(chan *Process, backlog)}
+}
+
+// Start returns a new Process for spec, or the error set with Fail.
+func (l *Launcher) Start(spec supervisor.ProcSpec) (supervisor.Process, error) {
+	l.mu.Lock()
+	if l.err != nil {
+		err := l.err
+		l.mu.Unlock()
+		return nil, err
+	}
+	l.next++
+	p := &Process{Spec: spec, pid: l.next, exited: make(chan struct{})}
+	l.children = append(l.children, p)
+	l.mu.Unlock()
+	l.started <- p
+	return p, nil
+}
+
+// Started delivers each child as it is started.
+func (l *Launcher) Started() <-chan *Process {
+	return l.started
+}
+
+// Children returns every child started so far, in order.
+func (l *Launcher) Children() []*Process {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]*Process(nil), l.children...)
+}
+
+// Fail has every later Start fail with err, or succeed again if err is
+// nil.
+func (l *Launcher) Fail(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.err = err
+}
+
+// Process is a child that doesn't exist. It is killed by any signal
+// that would kill a real program that doesn't handle it, or only by
+// SIGKILL once IgnoreSignals has been called.
+type Process struct {
+	Spec supervisor.ProcSpec
+
+	mu      sync.Mutex
+	pid     int
+	ignore  bool
+	signals []syscall.Signal
+	status  syscall.WaitStatus
+	exited  chan struct{}
+	once    sync.Once
+}
+
+func (p *Process) Pid() int {
+	return p.pid
+}
+
+// IgnoreSignals has the child ignore every signal it can, to test what
+// happens to a child that won't stop.
+func (p *Process) IgnoreSignals() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.ignore = true
+}
+
+// Signal records sig and ends the child if it would.
+func (p *Process) Signal(sig syscall.Signal) error {
+	p.mu.Lock()
+	if p.is_exited() {
+		p.mu.Unlock()
+		return syscall.ESRCH
+	}
+	p.signals = append(p.signals, sig)
+	ignore := p.ignore
+	p.mu.Unlock()
+	switch sig {
+	case 0, syscall.SIGCHLD, syscall.SIGURG, syscall.SIGWINCH, syscall.SIGCONT:
+		// Ignored by default, or not a signal.
+	case syscall.SIGKILL:
+		p.end(syscall.WaitStatus(sig))
+	default:
+		if !ignore {
+			p.end(syscall.WaitStatus(sig))
+		}
+	}
+	return nil
+}
+
+// Signals returns the signals the child was sent, in order.
+func (p *Process) Signals() []syscall.Signal {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]syscall.Signal(nil), p.signals...)
+}
+
+// Exit has the child exit with code, if it hasn't yet.
+func (p *Process) Exit(code int) {
+	p.end(syscall.WaitStatus((code & 0xff) << 8))
+}
+
+// Exited is closed once the child has exited.
+func (p *Process) Exited() <-chan struct{} {
+	return p.exited
+}
+
+func (p *Process) HasExited() bool {
+	return p.is_exited()
+}
+
+// Wait returns the status of the child once it has exited.
+func (p *Process) Wait() (syscall.WaitStatus, error) {
+	<-p.exited
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.status, nil
+}
+
+// end has the child exit with status, the first time only.
+func (p *Process) end(status syscall.WaitStatus) {
+	p.once.Do(func() {
+		p.mu.Lock()
+		p.status = status
+		p.mu.Unlock()
+		close(p.exited)
+	})
+}
+
+func (p *Process) is_exited() bool {
+	select {
+	case <-p.exited:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,224 @@
+package supervisor
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+)
+
+// Tee copies everything the producer writes to the stdin of each
+// consumer. Consumers come and go as they restart; one that stops
+// reading is dropped until it is attached again. With Options.Spill
+// what it missed in the meantime is kept on disk and replayed first.
+type Tee struct {
+	sup     *Supervisor
+	mu      sync.Mutex
+	outputs map[string]*os.File
+	// Data for the consumers that are down or catching up.
+	spills map[string]*spill
+	// Signalled when a spill has been replayed from, for SpillBlock.
+	drained *sync.Cond
+	closed  bool
+	// Set once the pipeline is being stopped, nothing will drain the
+	// spills any more.
+	stopping bool
+	done     chan struct{}
+}
+
+func new_tee(sup *Supervisor) *Tee {
+	t := &Tee{sup: sup, outputs: make(map[string]*os.File), spills: make(map[string]*spill), done: make(chan struct{})}
+	t.drained = sync.NewCond(&t.mu)
+	return t
+}
+
+// Attach makes w the output for role, replacing any previous one. If
+// data was spilled for role it is replayed to w first.
+func (t *Tee) Attach(role string, w *os.File) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if old := t.outputs[role]; old != nil {
+		old.Close()
+		delete(t.outputs, role)
+	}
+	if sp := t.spills[role]; sp != nil {
+		sp.reader = w
+		go t.replay(role, w, sp)
+		return
+	}
+	if t.closed {
+		w.Close()
+		return
+	}
+	t.outputs[role] = w
+}
+
+// detach drops w, which has stopped reading, as the output for role.
+// The rest of p, which was being written to it, is spilled if spilling
+// is on. Called with t.mu held.
+func (t *Tee) detach(role string, w *os.File, rest []byte) {
+	if t.outputs[role] != w {
+		return
+	}
+	delete(t.outputs, role)
+	w.Close()
+	if !t.sup.opts.Spill {
+		return
+	}
+	sp, err := new_spill(role, t.sup.opts.SpillMax)
+	if err != nil {
+		log.Errorf("Cannot spill the data for %s, it will miss it: %v", role, err)
+		return
+	}
+	log.Infof("%s is down, spilling its data to disk", role)
+	t.spills[role] = sp
+	t.spill(role, sp, rest)
+}
+
+// spill adds p to the spill of role, or waits for room with
+// Options.SpillBlock. Called with t.mu held.
+func (t *Tee) spill(role string, sp *spill, p []byte) {
+	if t.sup.opts.SpillBlock {
+		for int64(len(p)) > sp.room() && !t.stopping && t.spills[role] == sp {
+			if !sp.full {
+				sp.full = true
+				log.Warningf("The spill buffer of %s is full, holding the producer back", role)
+			}
+			t.drained.Wait()
+		}
+		if t.spills[role] != sp {
+			return
+		}
+	} else if int64(len(p)) > sp.room() && !sp.full {
+		sp.full = true
+		log.Warningf("The spill buffer of %s is full, dropping the oldest data", role)
+	}
+	if err := sp.write(p); err != nil {
+		log.Errorf("Cannot spill the data for %s, it will miss it: %v", role, err)
+		delete(t.spills, role)
+		sp.close()
+	}
+}
+
+// replay copies the spill of role to w, then makes w its live output.
+func (t *Tee) replay(role string, w *os.File, sp *spill) {
+	t.mu.Lock()
+	log.Infof("Replaying %d bytes to %s", sp.len(), role)
+	t.mu.Unlock()
+	buf := make([]byte, 32*1024)
+	for {
+		t.mu.Lock()
+		if sp.reader != w {
+			// Attached again since.
+			t.mu.Unlock()
+			w.Close()
+			return
+		}
+		from := sp.roff
+		n, err := sp.peek(buf)
+		if err != nil {
+			log.Errorf("Cannot read the spilled data for %s, it will miss it: %v", role, err)
+			n = 0
+		}
+		if n == 0 {
+			// Caught up, new data goes straight to w from here on.
+			delete(t.spills, role)
+			sp.close()
+			t.drained.Broadcast()
+			if t.closed {
+				w.Close()
+			} else {
+				t.outputs[role] = w
+			}
+			t.mu.Unlock()
+			log.Infof("%s has caught up", role)
+			return
+		}
+		t.mu.Unlock()
+		written, err := w.Write(buf[:n])
+		t.mu.Lock()
+		sp.discard(from, written)
+		t.drained.Broadcast()
+		t.mu.Unlock()
+		if err != nil {
+			// Down again, the rest stays spilled.
+			log.Debugf("%s stopped reading: %v", role, err)
+			w.Close()
+			return
+		}
+	}
+}
+
+// Run copies src to the outputs until src hits EOF, then closes them all
+// so the consumers see EOF too.
+func (t *Tee) Run(src *os.File) {
+	defer close(t.done)
+	defer src.Close()
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			t.write(buf[:n])
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Errorf("Reading from the producer failed: %v", err)
+			}
+			break
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	for role, w := range t.outputs {
+		w.Close()
+		delete(t.outputs, role)
+	}
+}
+
+func (t *Tee) write(p []byte) {
+	t.mu.Lock()
+	// Spill first, a consumer that catches up after this gets p live.
+	for role, sp := range t.spills {
+		t.spill(role, sp, p)
+	}
+	outputs := make(map[string]*os.File, len(t.outputs))
+	for role, w := range t.outputs {
+		outputs[role] = w
+	}
+	t.mu.Unlock()
+
+	for role, w := range outputs {
+		if n, err := w.Write(p); err != nil {
+			log.Debugf("%s stopped reading: %v", role, err)
+			t.mu.Lock()
+			t.detach(role, w, p[n:])
+			t.mu.Unlock()
+		}
+	}
+}
+
+// Respawn starts a consumer again on a new pipe, see start_tee_consumer.
+func (t *Tee) Respawn(ctx context.Context, stage Stage, comms chan ChildEvent) (int, error) {
+	pipes, err := t.sup.make_data_pipes(1)
+	if err != nil {
+		return -1, err
+	}
+	return t.sup.start_tee_consumer(ctx, stage, t, pipes[0], comms), nil
+}
+
+// Wait blocks until Run has finished, and drops the spills.
+func (t *Tee) Wait() {
+	t.mu.Lock()
+	t.stopping = true
+	t.drained.Broadcast()
+	t.mu.Unlock()
+	<-t.done
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for role, sp := range t.spills {
+		sp.close()
+		delete(t.spills, role)
+	}
+}
@@ -0,0 +1,33 @@
+package supervisor
+
+// replacement is the replacement of the last stage under
+// Options.ZeroDowntime, from the moment it is started until the data
+// has been switched over to it or it has been given up on.
+type replacement struct {
+	pump  *Pump
+	stage Stage
+	// The PID of the child being replaced, and of its replacement once
+	// it has forked.
+	old uintptr
+	pid uintptr
+	// The child's end of the replacement's pipe, until it has forked.
+	fd int
+	// Gets the outcome of the readiness check.
+	ready chan error
+}
+
+// ready_chan returns the channel the outcome of the readiness check
+// arrives on, nil if there is no replacement.
+func (r *replacement) ready_chan() chan error {
+	if r == nil {
+		return nil
+	}
+	return r.ready
+}
+
+// check_ready waits for the replacement to be ready, in the background.
+func (r *replacement) check_ready() {
+	go func() {
+		r.ready <- r.pump.replacement_ready(r.stage)
+	}()
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/msoulier/mrun/supervisor"
+)
+
+// The spans are sent with OTLP over HTTP in its JSON encoding, which
+// collectors take on the same port as protobuf.
+
+const (
+	// Spans are sent once this many are waiting, or after trace_interval.
+	trace_batch    = 64
+	trace_interval = 5 * time.Second
+	trace_timeout  = 10 * time.Second
+	// Spans waiting to be sent before new ones are dropped.
+	trace_queue_size = 1024
+)
+
+// otlp_span is a span as OTLP/JSON has it.
+type otlp_span struct {
+	TraceID      string           `json:"traceId"`
+	SpanID       string           `json:"spanId"`
+	ParentSpanID string           `json:"parentSpanId,omitempty"`
+	Name         string           `json:"name"`
+	Kind         int              `json:"kind"`
+	Start        string           `json:"startTimeUnixNano"`
+	End          string           `json:"endTimeUnixNano"`
+	Attributes   []otlp_attribute `json:"attributes,omitempty"`
+	Status       *otlp_status     `json:"status,omitempty"`
+}
+
+type otlp_attribute struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+type otlp_status struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+const (
+	span_kind_internal = 1
+	status_error       = 2
+)
+
+func string_attribute(key string, value string) otlp_attribute {
+	return otlp_attribute{key, map[string]any{"stringValue": value}}
+}
+
+func int_attribute(key string, value int64) otlp_attribute {
+	// 64 bit integers are strings in OTLP/JSON.
+	return otlp_attribute{key, map[string]any{"intValue": strconv.FormatInt(value, 10)}}
+}
+
+func unix_nano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// random_id returns n random bytes in hex, for trace and span IDs.
+func random_id(n int) string {
+	id := make([]byte, n)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// tracer turns the lifecycle events into one trace for the whole run of
+// mrun, with a span per child from its start to its exit.
+type tracer struct {
+	url     string
+	headers map[string]string
+	service string
+	client  *http.Client
+	queue   chan otlp_span
+	done    chan struct{}
+
+	trace   string
+	root    string
+	started time.Time
+	// The running children by PID, and how often each role started.
+	runs   map[uintptr]supervisor.Event
+	starts map[string]int64
+}
+
+var traces *tracer
+
+// trace_url returns where the spans go: endpoint, a base URL as for
+// OTEL_EXPORTER_OTLP_ENDPOINT, or else the standard variables. It is
+// empty if tracing isn't configured.
+func trace_url(endpoint string) string {
+	if endpoint == "" {
+		if traces_endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"); traces_endpoint != "" {
+			return traces_endpoint
+		}
+		endpoint = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	}
+	if endpoint == "" {
+		return ""
+	}
+	return strings.TrimSuffix(endpoint, "/") + "/v1/traces"
+}
+
+// parse_otlp_headers parses OTEL_EXPORTER_OTLP_HEADERS, key=value pairs
+// separated by commas with the values URL encoded.
+func parse_otlp_headers(s string) map[string]string {
+	headers := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		key, value, found := strings.Cut(pair, "=")
+		if !found {
+			continue
+		}
+		if unescaped, err := url.QueryUnescape(value); err == nil {
+			value = unescaped
+		}
+		headers[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return headers
+}
+
+// start_tracing sends a span for every run of a child to endpoint or, if
+// that is empty, where the OTEL_EXPORTER_OTLP_* variables say. It does
+// nothing at all if neither is set.
+func start_tracing(endpoint string) {
+	addr := trace_url(endpoint)
+	if addr == "" {
+		return
+	}
+	if protocol := os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL"); protocol != "" && protocol != "http/json" {
+		log.Warningf("OTEL_EXPORTER_OTLP_PROTOCOL is %s, but mrun only sends http/json", protocol)
+	}
+	service := os.Getenv("OTEL_SERVICE_NAME")
+	if service == "" {
+		service = "mrun"
+	}
+	headers := parse_otlp_headers(os.Getenv("OTEL_EXPORTER_OTLP_TRACES_HEADERS"))
+	if len(headers) == 0 {
+		headers = parse_otlp_headers(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"))
+	}
+	traces = &tracer{
+		url:     addr,
+		headers: headers,
+		service: service,
+		client:  &http.Client{Timeout: trace_timeout},
+		queue:   make(chan otlp_span, trace_queue_size),
+		done:    make(chan struct{}),
+		trace:   random_id(16),
+		root:    random_id(8),
+		started: time.Now(),
+		runs:    make(map[uintptr]supervisor.Event),
+		starts:  make(map[string]int64),
+	}
+	go traces.send_loop()
+	event_handlers = append(event_handlers, traces.handle)
+	log.Infof("Sending traces to %s", addr)
+}
+
+// handle makes a span out of each exit event.
+func (t *tracer) handle(ev supervisor.Event) {
+	switch ev.Type {
+	case supervisor.EventStarted:
+		t.runs[ev.Pid] = ev
+		t.starts[ev.Role]++
+	case supervisor.EventExited:
+		start, ok := t.runs[ev.Pid]
+		if !ok {
+			return
+		}
+		delete(t.runs, ev.Pid)
+		span := otlp_span{
+			TraceID:      t.trace,
+			SpanID:       random_id(8),
+			ParentSpanID: t.root,
+			Name:         ev.Role,
+			Kind:         span_kind_internal,
+			Start:        unix_nano(start.Time),
+			End:          unix_nano(ev.Time),
+			Attributes: []otlp_attribute{
+				string_attribute("mrun.role", ev.Role),
+				int_attribute("process.pid", int64(ev.Pid)),
+				int_attribute("mrun.restart_count", t.starts[ev.Role]-1),
+			},
+		}
+		if ev.ExitStatus != nil {
+			span.Attributes = append(span.Attributes, int_attribute("process.exit.code", int64(*ev.ExitStatus)))
+		}
+		if ev.Signal != "" {
+			span.Attributes = append(span.Attributes, string_attribute("mrun.signal", ev.Signal))
+		} else if ev.ExitStatus != nil && *ev.ExitStatus != 0 {
+			span.Status = &otlp_status{Code: status_error, Message: fmt.Sprintf("exit %d", *ev.ExitStatus)}
+		}
+		t.add(span)
+	case supervisor.EventStopped:
+		span := otlp_span{
+			TraceID: t.trace,
+			SpanID:  t.root,
+			Name:    "mrun",
+			Kind:    span_kind_internal,
+			Start:   unix_nano(t.started),
+			End:     unix_nano(ev.Time),
+		}
+		if ev.Error != "" {
+			span.Status = &otlp_status{Code: status_error, Message: ev.Error}
+		}
+		t.add(span)
+		close(t.queue)
+	}
+}
+
+// add queues span, or drops it if the sender is that far behind.
+func (t *tracer) add(span otlp_span) {
+	select {
+	case t.queue <- span:
+	default:
+		log.Debugf("Dropping the span of %s, too many are waiting to be sent", span.Name)
+	}
+}
+
+// send_loop sends the queued spans in batches until the queue is closed.
+func (t *tracer) send_loop() {
+	defer close(t.done)
+	ticker := time.NewTicker(trace_interval)
+	defer ticker.Stop()
+	var batch []otlp_span
+	for {
+		select {
+		case span, ok := <-t.queue:
+			if !ok {
+				t.send(batch)
+				return
+			}
+			batch = append(batch, span)
+			if len(batch) < trace_batch {
+				continue
+			}
+		case <-ticker.C:
+		}
+		t.send(batch)
+		batch = nil
+	}
+}
+
+// send POSTs spans, logging rather than retrying if that fails.
+func (t *tracer) send(spans []otlp_span) {
+	if len(spans) == 0 {
+		return
+	}
+	body := map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{"attributes": []otlp_attribute{string_attribute("service.name", t.service)}},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "mrun", "version": version},
+				"spans": spans,
+			}},
+		}},
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		log.Errorf("Cannot encode the spans: %v", err)
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, t.url, bytes.NewReader(data))
+	if err != nil {
+		log.Errorf("Cannot send the spans: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range t.headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		log.Warningf("Cannot send %d spans to %s: %v", len(spans), t.url, err)
+		return
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		log.Warningf("Cannot send %d spans to %s: %s", len(spans), t.url, resp.Status)
+	}
+}
+
+// stop_tracing waits a little for the last spans to be sent.
+func stop_tracing() {
+	if traces == nil {
+		return
+	}
+	select {
+	case <-traces.done:
+	case <-time.After(2 * time.Second):
+	}
+}
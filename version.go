@@ -0,0 +1,17 @@
+package main
+
+import "fmt"
+
+// Set at build time with -ldflags, e.g.
+//
+//	go build -ldflags "-X main.version=1.2.0 -X main.commit=$(git rev-parse --short HEAD) -X main.build_date=$(date -u +%FT%TZ)"
+var (
+	version    = "dev"
+	commit     = "unknown"
+	build_date = "unknown"
+)
+
+// print_version prints what -version shows.
+func print_version() {
+	fmt.Printf("mrun %s (commit %s, built %s)\n", version, commit, build_date)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// How long the programs have to be left alone after a change before the
+// stages are restarted. Editors often write a file several times.
+const watch_debounce = 500 * time.Millisecond
+
+// What a program being written or replaced looks like in its directory.
+const watch_events = unix.IN_CLOSE_WRITE | unix.IN_MODIFY | unix.IN_MOVED_TO | unix.IN_CREATE | unix.IN_ATTRIB
+
+// start_watching restarts each stage once its program has changed on
+// disk, using inotify. The directories are watched rather than the
+// programs themselves, so that a program that is replaced, as editors
+// do when saving, is still noticed.
+func start_watching() error {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		return fmt.Errorf("cannot use inotify: %v", err)
+	}
+	// The roles to restart by watch descriptor and name in the directory.
+	roles := make(map[int]map[string][]string)
+	for _, stage := range stages {
+		path, err := filepath.EvalSymlinks(stage.Path)
+		if err != nil {
+			unix.Close(fd)
+			return err
+		}
+		dir, name := filepath.Split(path)
+		wd, err := unix.InotifyAddWatch(fd, dir, watch_events)
+		if err != nil {
+			unix.Close(fd)
+			return fmt.Errorf("cannot watch %s: %v", dir, err)
+		}
+		if roles[wd] == nil {
+			roles[wd] = make(map[string][]string)
+		}
+		roles[wd][name] = append(roles[wd][name], stage.Role)
+		log.Infof("Restarting %s when %s changes", stage.Role, path)
+	}
+	// Reset on every change, so that each fires once things are quiet.
+	timers := make(map[string]*time.Timer)
+	changed := func(role string) {
+		if timer, ok := timers[role]; ok {
+			timer.Reset(watch_debounce)
+			return
+		}
+		timers[role] = time.AfterFunc(watch_debounce, func() {
+			log.Warningf("The program of %s has changed, restarting it", role)
+			if err := sup.RestartStage(role); err != nil {
+				log.Errorf("Cannot restart %s: %v", role, err)
+			}
+		})
+	}
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, err := unix.Read(fd, buf)
+			if err == unix.EINTR {
+				continue
+			}
+			if err != nil {
+				log.Errorf("Cannot read the inotify events: %v", err)
+				return
+			}
+			for off := 0; off+unix.SizeofInotifyEvent <= n; {
+				ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+				name := buf[off+unix.SizeofInotifyEvent : off+unix.SizeofInotifyEvent+int(ev.Len)]
+				off += unix.SizeofInotifyEvent + int(ev.Len)
+				if ev.Mask&unix.IN_Q_OVERFLOW != 0 {
+					log.Warning("Too many changes at once, some may have been missed")
+					continue
+				}
+				for _, role := range roles[int(ev.Wd)][string(bytes.TrimRight(name, "\x00"))] {
+					changed(role)
+				}
+			}
+		}
+	}()
+	return nil
+}
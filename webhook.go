@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/msoulier/mrun/supervisor"
+)
+
+const (
+	// How long one POST may take, and how many are tried.
+	webhook_timeout  = 5 * time.Second
+	webhook_attempts = 3
+	// Payloads waiting to be sent before new ones are dropped.
+	webhook_queue_size = 64
+)
+
+// webhook_payload is what is POSTed to -webhook-url. For restarting, Role
+// is the stage that exited, none for a restart through the control API;
+// for stopped, the stage whose exit ended the pipeline, if one did.
+type webhook_payload struct {
+	Time       time.Time            `json:"timestamp"`
+	Event      supervisor.EventType `json:"event"`
+	Role       string               `json:"role,omitempty"`
+	ExitStatus *int                 `json:"exit_status,omitempty"`
+	Signal     string               `json:"signal,omitempty"`
+	// The restarts caused by Role so far, or all of them without it.
+	Restarts uint64 `json:"restarts"`
+	Error    string `json:"error,omitempty"`
+}
+
+var (
+	webhook_queue   chan webhook_payload
+	webhook_pending sync.WaitGroup
+)
+
+// start_webhook POSTs a webhook_payload to addr whenever the pipeline or
+// a stage is about to be restarted, and once it has stopped. Sending
+// happens in the background, with retries; payloads that can't be sent
+// are logged and dropped.
+func start_webhook(addr string) error {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%q is not an http or https URL", addr)
+	}
+	webhook_queue = make(chan webhook_payload, webhook_queue_size)
+	client := &http.Client{Timeout: webhook_timeout}
+	go func() {
+		for payload := range webhook_queue {
+			send_webhook(client, addr, payload)
+			webhook_pending.Done()
+		}
+	}()
+
+	// Kept by the handler, which the events are passed to in order.
+	exits := make(map[string]supervisor.Event)
+	restarts := make(map[string]uint64)
+	var total uint64
+	// The first exit since the last restart, unless we are stopping.
+	var cause *supervisor.Event
+	stopping := false
+	payload := func(ev supervisor.Event, role string) webhook_payload {
+		p := webhook_payload{Time: ev.Time, Event: ev.Type, Role: role, Restarts: total, Error: ev.Error}
+		if role != "" {
+			p.ExitStatus = exits[role].ExitStatus
+			p.Signal = exits[role].Signal
+			p.Restarts = restarts[role]
+		}
+		return p
+	}
+	event_handlers = append(event_handlers, func(ev supervisor.Event) {
+		switch ev.Type {
+		case supervisor.EventExited:
+			exits[ev.Role] = ev
+			if cause == nil && !stopping {
+				cause = &ev
+			}
+		case supervisor.EventShuttingDown:
+			stopping = true
+		case supervisor.EventRestarting:
+			if ev.Role != "" {
+				restarts[ev.Role]++
+			}
+			total++
+			cause = nil
+			queue_webhook(payload(ev, ev.Role))
+		case supervisor.EventStopped:
+			role := ""
+			if cause != nil {
+				role = cause.Role
+			}
+			queue_webhook(payload(ev, role))
+		}
+	})
+	return nil
+}
+
+// queue_webhook hands payload to the sender, or drops it if the sender
+// is that far behind.
+func queue_webhook(payload webhook_payload) {
+	webhook_pending.Add(1)
+	select {
+	case webhook_queue <- payload:
+	default:
+		webhook_pending.Done()
+		log.Warningf("Dropping the %s webhook, %d are still waiting to be sent", payload.Event, webhook_queue_size)
+	}
+}
+
+// send_webhook POSTs payload to addr, trying again a couple of times if
+// that fails.
+func send_webhook(client *http.Client, addr string, payload webhook_payload) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		log.Errorf("Cannot encode the %s webhook: %v", payload.Event, err)
+		return
+	}
+	for attempt := 1; ; attempt++ {
+		err := post_webhook(client, addr, data)
+		if err == nil {
+			log.Debugf("Sent the %s webhook", payload.Event)
+			return
+		}
+		if attempt == webhook_attempts {
+			log.Errorf("Cannot send the %s webhook, giving up: %v", payload.Event, err)
+			return
+		}
+		log.Warningf("Cannot send the %s webhook (attempt %d of %d): %v", payload.Event, attempt, webhook_attempts, err)
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+}
+
+func post_webhook(client *http.Client, addr string, data []byte) error {
+	resp, err := client.Post(addr, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
+
+// stop_webhook gives the webhooks still queued, such as that of the
+// stop, a few seconds to be sent.
+func stop_webhook() {
+	if webhook_queue == nil {
+		return
+	}
+	sent := make(chan struct{})
+	go func() {
+		webhook_pending.Wait()
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-time.After(webhook_timeout):
+		log.Warning("Not waiting any longer for the webhooks to be sent")
+	}
+}